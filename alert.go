@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+
+	// the amount of notifications waiting to be sent, more notifications are dropped
+	alertQueueSize = 256
+)
+
+// AlertRule fires when the value of Metric in its key range is above Above, or its share of the value of
+// the whole cluster is above ShareAbove, for at least For. If both are given, both should be satisfied.
+// The key range is a table or an index of it given by DB, Table and Index, or a hex key range [StartKey, EndKey),
+// or the whole key space if none is given. If PerRegion is true, each region in the key range is checked separately.
+type AlertRule struct {
+	Name       string  `json:"name" yaml:"name"`
+	Metric     string  `json:"metric" yaml:"metric"` // one of the tags of heatmaps, e.g. "written_bytes"
+	DB         string  `json:"db,omitempty" yaml:"db,omitempty"`
+	Table      string  `json:"table,omitempty" yaml:"table,omitempty"`
+	Index      string  `json:"index,omitempty" yaml:"index,omitempty"`
+	StartKey   string  `json:"start_key,omitempty" yaml:"start_key,omitempty"`
+	EndKey     string  `json:"end_key,omitempty" yaml:"end_key,omitempty"`
+	PerRegion  bool    `json:"per_region,omitempty" yaml:"per_region,omitempty"`
+	Above      uint64  `json:"above,omitempty" yaml:"above,omitempty"`
+	ShareAbove float64 `json:"share_above,omitempty" yaml:"share_above,omitempty"`
+	For        string  `json:"for,omitempty" yaml:"for,omitempty"`         // a duration, e.g. "5m"
+	Webhook    string  `json:"webhook,omitempty" yaml:"webhook,omitempty"` // the webhook of the rule set by default
+}
+
+// AlertRuleSet is the content of an alert rule file
+type AlertRuleSet struct {
+	Webhook string       `json:"webhook" yaml:"webhook"` // the default webhook of rules
+	Rules   []*AlertRule `json:"rules" yaml:"rules"`
+}
+
+// validate checks the rules, and returns the durations of them
+func (set *AlertRuleSet) validate() (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration, len(set.Rules))
+	for _, rule := range set.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("the name of a rule is empty")
+		}
+		if _, ok := durations[rule.Name]; ok {
+			return nil, fmt.Errorf("duplicated rule %s", rule.Name)
+		}
+		if !isHeatmapTag(rule.Metric) {
+			return nil, fmt.Errorf("rule %s: invalid metric %q", rule.Name, rule.Metric)
+		}
+		if rule.Above == 0 && rule.ShareAbove <= 0 {
+			return nil, fmt.Errorf("rule %s: one of above and share_above should be given", rule.Name)
+		}
+		if rule.ShareAbove < 0 || rule.ShareAbove > 1 {
+			return nil, fmt.Errorf("rule %s: share_above should be in [0, 1]", rule.Name)
+		}
+		if (rule.DB != "" || rule.Table != "" || rule.Index != "") && (rule.StartKey != "" || rule.EndKey != "") {
+			return nil, fmt.Errorf("rule %s: a table and a key range cannot be given at the same time", rule.Name)
+		}
+		if (rule.Table == "") != (rule.DB == "") || (rule.Index != "" && rule.Table == "") {
+			return nil, fmt.Errorf("rule %s: both db and table should be given for a table or an index", rule.Name)
+		}
+		if rule.Webhook == "" && set.Webhook == "" {
+			return nil, fmt.Errorf("rule %s: no webhook is given", rule.Name)
+		}
+		var duration time.Duration
+		if rule.For != "" {
+			var err error
+			if duration, err = time.ParseDuration(rule.For); err != nil || duration < 0 {
+				return nil, fmt.Errorf("rule %s: invalid duration %q", rule.Name, rule.For)
+			}
+		}
+		durations[rule.Name] = duration
+	}
+	return durations, nil
+}
+
+// keyRange returns the key range of the rule, which is looked up in the schema if a table is given
+func (rule *AlertRule) keyRange() (startKey string, endKey string, err error) {
+	form := url.Values{}
+	for name, value := range map[string]string{
+		"db": rule.DB, "table": rule.Table, "index": rule.Index, "startkey": rule.StartKey, "endkey": rule.EndKey,
+	} {
+		if value != "" {
+			form.Set(name, value)
+		}
+	}
+	return parseKeyRange(form)
+}
+
+// Alert is an alert which is firing or has been resolved
+type Alert struct {
+	Status   string     `json:"status"` // "firing" or "resolved"
+	Rule     string     `json:"rule"`
+	Metric   string     `json:"metric"`
+	StartKey string     `json:"start_key"`
+	EndKey   string     `json:"end_key"`
+	Label    string     `json:"label"`
+	Value    uint64     `json:"value"`
+	Share    float64    `json:"share"`
+	StartsAt time.Time  `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+
+	webhook string
+	// the time since when the condition holds, the alert fires when it holds for the duration of the rule
+	pendingSince time.Time
+}
+
+// ruleKeyRange is the key range of a rule, or the error of looking it up
+type ruleKeyRange struct {
+	startKey string
+	endKey   string
+	err      error
+}
+
+// AlertRuleStore keeps the alert rules and the states of their alerts
+type AlertRuleStore struct {
+	sync.Mutex
+	path      string
+	set       *AlertRuleSet
+	durations map[string]time.Duration
+	// the pending and firing alerts, by the rule name and the key range
+	alerts map[string]*Alert
+	// the key ranges of the rules, which are looked up again when the rules or the index of tables change
+	ranges      map[string]ruleKeyRange
+	rangesIndex *LabelIndex
+	// the notifications to be sent by notifyAlerts
+	queue chan *Alert
+}
+
+func newAlertRuleStore() *AlertRuleStore {
+	return &AlertRuleStore{
+		set:    &AlertRuleSet{},
+		alerts: make(map[string]*Alert),
+		queue:  make(chan *Alert, alertQueueSize),
+	}
+}
+
+var alertRules = newAlertRuleStore()
+
+// Load loads the rules from the file, which is also used to save the rules changed through API
+// a missing file is regarded as empty, and will be created when the rules are changed
+func (s *AlertRuleStore) Load(path string) error {
+	s.Lock()
+	s.path = path
+	s.Unlock()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	set := &AlertRuleSet{}
+	if err := unmarshalRuleFile(path, data, set); err != nil {
+		return fmt.Errorf("parse %s: %s", path, err.Error())
+	}
+	return s.update(set, false)
+}
+
+// Reload loads the rules from the file again. The rules are cleared if path is empty, or if the file is missing
+// or unreadable, whose error is returned. The rules are kept if the file is invalid.
+func (s *AlertRuleStore) Reload(path string) error {
+	var err error
+	if path != "" {
+		if _, err = ioutil.ReadFile(path); err == nil {
+			return s.Load(path)
+		}
+	}
+	s.Lock()
+	s.path = path
+	s.Unlock()
+	if clearErr := s.update(&AlertRuleSet{}, false); clearErr != nil {
+		return clearErr
+	}
+	return err
+}
+
+// update validates the rules and puts them in effect, they are saved into the rule file if save is true.
+// The firing alerts of removed rules are resolved.
+func (s *AlertRuleStore) update(set *AlertRuleSet, save bool) error {
+	durations, err := set.validate()
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if save && s.path != "" {
+		if err := writeRuleFile(s.path, set); err != nil {
+			return err
+		}
+	}
+	s.set = set
+	s.durations = durations
+	s.ranges = nil
+	now := time.Now()
+	for id, alert := range s.alerts {
+		if _, ok := durations[alert.Rule]; !ok {
+			delete(s.alerts, id)
+			if alert.Status == alertFiring {
+				alert.Status, alert.EndsAt = alertResolved, &now
+				s.enqueue(alert)
+			}
+		}
+	}
+	return nil
+}
+
+// keyRanges returns the key ranges of the rules in set, which are looked up in the schema only if the rules or
+// the index of tables have changed since the last time. The lookup is done without holding the lock.
+func (s *AlertRuleStore) keyRanges(set *AlertRuleSet) map[string]ruleKeyRange {
+	index := tables.labelIndex()
+	s.Lock()
+	ranges := s.ranges
+	if ranges != nil && s.set == set && s.rangesIndex == index {
+		s.Unlock()
+		return ranges
+	}
+	s.Unlock()
+	ranges = make(map[string]ruleKeyRange, len(set.Rules))
+	for _, rule := range set.Rules {
+		var r ruleKeyRange
+		r.startKey, r.endKey, r.err = rule.keyRange()
+		if r.err != nil {
+			lerr(fmt.Errorf("alert rule %s: %s", rule.Name, r.err.Error()))
+		}
+		ranges[rule.Name] = r
+	}
+	s.Lock()
+	if s.set == set {
+		s.ranges, s.rangesIndex = ranges, index
+	}
+	s.Unlock()
+	return ranges
+}
+
+func (s *AlertRuleStore) get() *AlertRuleSet {
+	s.Lock()
+	defer s.Unlock()
+	return s.set
+}
+
+// alertLine is a line of an axis which covers [startKey, endKey)
+type alertLine struct {
+	startKey string
+	endKey   string
+	value    uint64
+}
+
+// evaluate checks the rules with the axis stored at the time at, and returns the alerts to be notified
+func (s *AlertRuleStore) evaluate(axis *DiscreteAxis, at time.Time) []*Alert {
+	ranges := s.keyRanges(s.get())
+	s.Lock()
+	defer s.Unlock()
+	notifications := make([]*Alert, 0)
+	var index *LabelIndex
+	for _, rule := range s.set.Rules {
+		r, ok := ranges[rule.Name]
+		if !ok || r.err != nil {
+			continue
+		}
+		startKey, endKey := r.startKey, r.endKey
+		separateValue := separateValueFunc(rule.Metric, "")
+		var total uint64
+		candidates := make([]*alertLine, 0)
+		lineStart := axis.StartKey
+		for _, line := range axis.Lines {
+			value := separateValue(line.RegionUnit).(*SingleUnit).Value
+			total += value
+			if line.EndKey > startKey && lineStart < endKey {
+				candidates = append(candidates, &alertLine{lineStart, line.EndKey, value})
+			}
+			lineStart = line.EndKey
+		}
+		if !rule.PerRegion {
+			sum := &alertLine{startKey: startKey, endKey: endKey}
+			for _, line := range candidates {
+				sum.value += line.value
+			}
+			candidates = []*alertLine{sum}
+		}
+
+		seen := make(map[string]struct{}, len(candidates))
+		for _, line := range candidates {
+			share := 0.0
+			if total > 0 {
+				share = float64(line.value) / float64(total)
+			}
+			if (rule.Above > 0 && line.value <= rule.Above) || (rule.ShareAbove > 0 && share <= rule.ShareAbove) {
+				continue
+			}
+			id := rule.Name + "/" + line.startKey + "/" + line.endKey
+			seen[id] = struct{}{}
+			alert, ok := s.alerts[id]
+			if !ok {
+				if index == nil {
+					index = tables.labelIndex()
+				}
+				names := make([]string, 0)
+				for _, label := range queryLabels(index, line.startKey, line.endKey, at, at) {
+					names = append(names, label.String())
+				}
+				alert = &Alert{
+					Rule:         rule.Name,
+					Metric:       rule.Metric,
+					StartKey:     line.startKey,
+					EndKey:       line.endKey,
+					Label:        strings.Join(names, "; "),
+					pendingSince: at,
+				}
+				s.alerts[id] = alert
+			}
+			alert.Value, alert.Share = line.value, share
+			alert.webhook = rule.Webhook
+			if alert.webhook == "" {
+				alert.webhook = s.set.Webhook
+			}
+			if alert.Status == "" && at.Sub(alert.pendingSince) >= s.durations[rule.Name] {
+				alert.Status, alert.StartsAt = alertFiring, at
+				notification := *alert
+				notifications = append(notifications, &notification)
+			}
+		}
+		for id, alert := range s.alerts {
+			if _, ok := seen[id]; ok || alert.Rule != rule.Name {
+				continue
+			}
+			delete(s.alerts, id)
+			if alert.Status == alertFiring {
+				endsAt := at
+				alert.Status, alert.EndsAt = alertResolved, &endsAt
+				notifications = append(notifications, alert)
+			}
+		}
+	}
+	return notifications
+}
+
+// notify posts the alert to its webhook, which is canceled with ctx
+func notify(ctx context.Context, alert *Alert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, alert.webhook, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s responds %s", alert.webhook, resp.Status)
+	}
+	return nil
+}
+
+// enqueue queues the notification of the alert without blocking, it is dropped if the queue is full
+func (s *AlertRuleStore) enqueue(alert *Alert) {
+	select {
+	case s.queue <- alert:
+	default:
+		lerr(fmt.Errorf("the notification queue is full, drop the %s alert of rule %s", alert.Status, alert.Rule))
+	}
+}
+
+// Evaluate checks the rules with the axis stored at the time at, and queues the notifications of the alerts
+// which fire or are resolved, so that a slow webhook does not block the collection
+func (s *AlertRuleStore) Evaluate(axis *DiscreteAxis, at time.Time) {
+	if axis == nil {
+		return
+	}
+	for _, alert := range s.evaluate(axis, at) {
+		s.enqueue(alert)
+	}
+}
+
+// sendNotifications sends the queued notifications in order until ctx is canceled
+func (s *AlertRuleStore) sendNotifications(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case alert := <-s.queue:
+			lerr(notify(ctx, alert))
+		}
+	}
+}
+
+func notifyAlerts(ctx context.Context) {
+	alertRules.sendNotifications(ctx)
+}
+
+// firing returns the alerts which are firing, ordered by their start time
+func (s *AlertRuleStore) firing() []*Alert {
+	s.Lock()
+	defer s.Unlock()
+	alerts := make([]*Alert, 0)
+	for _, alert := range s.alerts {
+		if alert.Status == alertFiring {
+			a := *alert
+			alerts = append(alerts, &a)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].StartsAt.Before(alerts[j].StartsAt) })
+	return alerts
+}
+
+// alertRulesHandler gets the rules by GET, replaces the rules by PUT with a JSON body, and removes all rules by DELETE
+func alertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, alertRules.get())
+	case http.MethodPut:
+		var set AlertRuleSet
+		if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := set.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := alertRules.update(&set, true); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, &set)
+	case http.MethodDelete:
+		if err := alertRules.update(&AlertRuleSet{}, true); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// alertsHandler returns the alerts which are firing
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, alertRules.firing())
+}
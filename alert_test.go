@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testalerttablepath = "../test/alert_table"
+
+func TestAlertRuleSet_validate(t *testing.T) {
+	valid := &AlertRuleSet{Webhook: "http://127.0.0.1/hook", Rules: []*AlertRule{
+		{Name: "a", Metric: "written_bytes", DB: "sales", Table: "orders", Above: 1, For: "5m"},
+		{Name: "b", Metric: "read_bytes", PerRegion: true, ShareAbove: 0.3},
+	}}
+	durations, err := valid.validate()
+	perr(err)
+	if durations["a"] != 5*time.Minute || durations["b"] != 0 {
+		t.Fatalf("error durations %v", durations)
+	}
+	for _, rule := range []*AlertRule{
+		{Name: "", Metric: "written_bytes", Above: 1},
+		{Name: "a", Metric: "written", Above: 1},
+		{Name: "a", Metric: "written_bytes"},
+		{Name: "a", Metric: "written_bytes", ShareAbove: 2},
+		{Name: "a", Metric: "written_bytes", Above: 1, Table: "orders"},
+		{Name: "a", Metric: "written_bytes", Above: 1, DB: "sales", Table: "orders", StartKey: "74"},
+		{Name: "a", Metric: "written_bytes", Above: 1, For: "5 minutes"},
+	} {
+		set := &AlertRuleSet{Webhook: "http://127.0.0.1/hook", Rules: []*AlertRule{rule}}
+		if _, err := set.validate(); err == nil {
+			t.Fatalf("expect error for %v", rule)
+		}
+	}
+	if _, err := (&AlertRuleSet{Rules: []*AlertRule{{Name: "a", Metric: "written_bytes", Above: 1}}}).validate(); err == nil {
+		t.Fatalf("expect error without webhook")
+	}
+}
+
+func TestAlertRuleStore_Evaluate(t *testing.T) {
+	// the tables of the last run are removed, since the schema is changed during the test
+	perr(os.RemoveAll(testalerttablepath))
+	openTestTables(testalerttablepath)
+	defer tables.LeveldbStorage.Close()
+	saveTestTables(&Table{Name: "orders", DB: "sales", ID: 45, Indices: map[int64]string{}})
+
+	var mu sync.Mutex
+	received := make([]string, 0)
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		perr(json.NewDecoder(r.Body).Decode(&alert))
+		mu.Lock()
+		received = append(received, r.URL.Path+" "+alert.Status+" "+alert.Rule+" "+alert.Label)
+		mu.Unlock()
+	}))
+	defer stub.Close()
+
+	store := newAlertRuleStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.sendNotifications(ctx)
+	// waits until n notifications are received
+	wait := func(n int) []string {
+		for i := 0; i < 100; i++ {
+			mu.Lock()
+			result := append([]string(nil), received...)
+			mu.Unlock()
+			if len(result) >= n {
+				return result
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expect %d notifications, but got %v", n, received)
+		return nil
+	}
+	perr(store.update(&AlertRuleSet{Webhook: stub.URL + "/default", Rules: []*AlertRule{
+		{Name: "orders-write", Metric: "written_bytes", DB: "sales", Table: "orders", Above: 100, For: "2m"},
+		{Name: "region-read", Metric: "read_bytes", PerRegion: true, ShareAbove: 0.5, Webhook: stub.URL + "/read"},
+	}}, false))
+
+	start := time.Unix(1574000000, 0)
+	newAxis := func(written uint64, read uint64) *DiscreteAxis {
+		return &DiscreteAxis{Lines: []*Line{
+			{EndKey: GenTablePrefix(45), RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, 10, 0))},
+			{EndKey: GenTablePrefix(46), RegionUnit: newRegionUnit(newRegionInfo("", "", written, 0, 10, 0))},
+			{EndKey: "~", RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, read, 0))},
+		}}
+	}
+	store.Evaluate(newAxis(200, 80), start)
+	store.Evaluate(newAxis(200, 80), start.Add(time.Minute))
+	if firing := store.firing(); len(firing) != 1 || firing[0].Rule != "region-read" || firing[0].StartKey != GenTablePrefix(46) {
+		t.Fatalf("error firing alerts %v", firing)
+	}
+	store.Evaluate(newAxis(200, 10), start.Add(2*time.Minute))
+	store.Evaluate(newAxis(50, 10), start.Add(3*time.Minute))
+
+	expect := []string{
+		"/read firing region-read ",
+		"/default firing orders-write sales.orders",
+		"/read resolved region-read ",
+		"/default resolved orders-write sales.orders",
+	}
+	if result := wait(len(expect)); !reflect.DeepEqual(result, expect) {
+		t.Fatalf("expect %v, but got %v", expect, result)
+	}
+	if firing := store.firing(); len(firing) != 0 {
+		t.Fatalf("expect no firing alerts, but got %v", firing)
+	}
+
+	// the key ranges are looked up again after the schema changes
+	if store.rangesIndex != tables.labelIndex() {
+		t.Fatalf("expect the key ranges are resolved with the current index")
+	}
+	saveTestTables(
+		&Table{Name: "orders_old", DB: "sales", ID: 45, Indices: map[int64]string{}},
+		&Table{Name: "orders", DB: "sales", ID: 47, Indices: map[int64]string{}},
+	)
+	if r := store.keyRanges(store.get())["orders-write"]; r.startKey != GenTablePrefix(47) {
+		t.Fatalf("expect the key range of the new table, but got %v", r)
+	}
+
+	// the firing alert of a removed rule is resolved
+	store.Evaluate(newAxis(200, 80), start.Add(4*time.Minute))
+	perr(store.update(&AlertRuleSet{Webhook: stub.URL + "/default"}, false))
+	expect = append(expect, "/read firing region-read sales.orders", "/read resolved region-read sales.orders")
+	if result := wait(len(expect)); !reflect.DeepEqual(result, expect) {
+		t.Fatalf("expect %v, but got %v", expect, result)
+	}
+}
+
+func TestAlertRuleStore_Reload(t *testing.T) {
+	store := newAlertRuleStore()
+	perr(store.update(&AlertRuleSet{Webhook: "http://127.0.0.1/hook", Rules: []*AlertRule{
+		{Name: "a", Metric: "written_bytes", Above: 1},
+	}}, false))
+	if err := store.Reload("../test/alert_rules_missing.yaml"); err == nil || len(store.get().Rules) != 0 {
+		t.Fatalf("expect error and no rules when the rule file is missing, but got %v", err)
+	}
+	perr(store.update(&AlertRuleSet{Webhook: "http://127.0.0.1/hook", Rules: []*AlertRule{
+		{Name: "a", Metric: "written_bytes", Above: 1},
+	}}, false))
+	if err := store.Reload(""); err != nil || len(store.get().Rules) != 0 {
+		t.Fatalf("expect the rules are cleared without a path, but got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// tokenSet is the set of bearer tokens accepted by authHandler, which is replaced when -auth-tokens is reloaded
+type tokenSet struct {
+	sync.RWMutex
+	tokens []string
+}
+
+var apiTokens tokenSet
+
+// set replaces the tokens with the ones separated by comma in source, an empty source disables authentication
+func (s *tokenSet) set(source string) {
+	tokens := make([]string, 0)
+	for _, token := range strings.Split(source, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	s.Lock()
+	s.tokens = tokens
+	s.Unlock()
+}
+
+// check returns whether r carries an accepted token, by the Authorization header or the access_token parameter,
+// the latter is for EventSource which cannot set headers
+func (s *tokenSet) check(r *http.Request) bool {
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.tokens) == 0 {
+		return true
+	}
+	token := r.URL.Query().Get("access_token")
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	if token == "" {
+		return false
+	}
+	accepted := false
+	// every token is compared in constant time, so that the time does not tell how much of a token is matched
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			accepted = true
+		}
+	}
+	return accepted
+}
+
+// authHandler rejects the requests without an accepted token
+func authHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !apiTokens.check(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="key-visual"`)
+			http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/HunDunDM/key-visual/matrix"
+	"golang.org/x/sync/singleflight"
+	"sync"
+	"time"
+)
+
+// HeatmapCache memoises the heatmaps of normalised queries, and evicts the least recently used ones beyond *cacheSize.
+// Concurrent identical queries are generated once.
+type HeatmapCache struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// increased when the open entries are invalidated
+	generation uint64
+	group      singleflight.Group
+}
+
+// heatmapCacheEntry is a cached heatmap with the label indices it is matched with,
+// it is stale if either of the indices has been replaced
+type heatmapCacheEntry struct {
+	key     string
+	heatmap *Heatmap
+	// the time range reaches beyond the latest stored axis, so the next axis will be included
+	open   bool
+	tables *LabelIndex
+	rules  *LabelIndex
+
+	// the pixelation of a sliding window instead of a heatmap, which is extended by the new axes
+	windowLock sync.Mutex
+	window     *matrix.SlidingPlane
+}
+
+func newHeatmapCache() *HeatmapCache {
+	return &HeatmapCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+var heatmapCache = newHeatmapCache()
+
+// normaliseTimeRange rounds the start time down and the end time up to the interval of collection,
+// so that the queries within the same intervals share the same heatmap
+func normaliseTimeRange(startTime time.Time, endTime time.Time) (time.Time, time.Time) {
+	startTime = startTime.Truncate(*interval)
+	if t := endTime.Truncate(*interval); t.Before(endTime) {
+		endTime = t.Add(*interval)
+	}
+	return startTime, endTime
+}
+
+// Generate returns the heatmap like GenerateHeatmap with the time range normalised, from the cache if possible.
+// The returned heatmap is shared and must not be modified.
+func (c *HeatmapCache) Generate(startTime time.Time, endTime time.Time, startKey string, endKey string, tag, mode string) *Heatmap {
+	startTime, endTime = normaliseTimeRange(startTime, endTime)
+	if *cacheSize <= 0 {
+		return GenerateHeatmap(startTime, endTime, startKey, endKey, tag, mode)
+	}
+	key := fmt.Sprintf("%d/%d/%q/%q/%s/%s/%dx%d", startTime.Unix(), endTime.Unix(), startKey, endKey, tag, mode,
+		*maxDisplayTimes, *maxDisplayKeys)
+	tableIndex := tables.labelIndex()
+	_, ruleIndex := labelRules.get()
+	if hmap, ok := c.get(key, tableIndex, ruleIndex); ok {
+		cacheRequests.WithLabelValues("hit").Inc()
+		return hmap
+	}
+	cacheRequests.WithLabelValues("miss").Inc()
+	v, _, _ := c.group.Do(key, func() (interface{}, error) {
+		c.Lock()
+		generation := c.generation
+		c.Unlock()
+		_, latest, ok := globalRegionStore.TimeRange()
+		entry := &heatmapCacheEntry{
+			key:    key,
+			open:   !ok || endTime.After(latest),
+			tables: tableIndex,
+			rules:  ruleIndex,
+		}
+		if entry.open {
+			entry.heatmap = c.slide(startTime, endTime, startKey, endKey, tag, mode)
+		} else {
+			entry.heatmap = GenerateHeatmap(startTime, endTime, startKey, endKey, tag, mode)
+		}
+		c.put(entry, generation)
+		return entry.heatmap, nil
+	})
+	return v.(*Heatmap)
+}
+
+// slide generates the heatmap of a time range reaching the latest axis, by moving the sliding window of the same
+// length forward with the axes stored after it, within the tolerance of matrix.SlidingPlane.
+// The window is rebuilt if it has been moved beyond the time range, or starts later than it by more than a column.
+func (c *HeatmapCache) slide(startTime time.Time, endTime time.Time, startKey string, endKey string, tag, mode string) *Heatmap {
+	key := fmt.Sprintf("window/%d/%q/%q/%s/%s/%dx%d", endTime.Sub(startTime)/time.Second, startKey, endKey, tag, mode,
+		*maxDisplayTimes, *maxDisplayKeys)
+	c.Lock()
+	elem, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.Unlock()
+	if ok {
+		entry := elem.Value.(*heatmapCacheEntry)
+		entry.windowLock.Lock()
+		defer entry.windowLock.Unlock()
+		// the history before the earliest axis is not in the window anyway
+		wanted := startTime
+		if earliest, _, ok := globalRegionStore.TimeRange(); ok && wanted.Before(earliest) {
+			wanted = earliest
+		}
+		column := *interval
+		if n := *maxDisplayTimes; n > 0 && endTime.Sub(startTime)/time.Duration(n) > column {
+			column = endTime.Sub(startTime) / time.Duration(n)
+		}
+		// a window built for the time range starts an interval before it, since an axis covers the interval before it
+		window := entry.window
+		if !window.EndTime().Before(startTime) && !window.StartTime().After(wanted.Add(column-*interval)) {
+			if plane := rangePlane(window.EndTime().Add(time.Second), endTime, startKey, endKey, tag, mode); plane != nil {
+				window.Advance(plane.Axes, startTime)
+			}
+			return MatchTable(ChangeIntoHeatmap(window.Matrix()))
+		}
+	}
+	plane := rangePlane(startTime, endTime, startKey, endKey, tag, mode)
+	if plane == nil {
+		return nil
+	}
+	entry := &heatmapCacheEntry{key: key, window: matrix.NewSlidingPlane(plane, *maxDisplayTimes, *maxDisplayKeys)}
+	heatmap := MatchTable(ChangeIntoHeatmap(entry.window.Matrix()))
+	c.Lock()
+	generation := c.generation
+	c.Unlock()
+	c.put(entry, generation)
+	return heatmap
+}
+
+func (c *HeatmapCache) get(key string, tableIndex *LabelIndex, ruleIndex *LabelIndex) (*Heatmap, bool) {
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*heatmapCacheEntry)
+	if entry.tables != tableIndex || entry.rules != ruleIndex {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.heatmap, true
+}
+
+// put adds entry generated in generation, an open entry is dropped if it may have missed an invalidation
+func (c *HeatmapCache) put(entry *heatmapCacheEntry, generation uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if entry.open && generation != c.generation {
+		return
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > *cacheSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes elem from the cache, the caller should hold the lock
+func (c *HeatmapCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*heatmapCacheEntry).key)
+}
+
+// InvalidateOpen removes the heatmaps whose time ranges reach beyond the latest stored axis,
+// which is called after a new axis is stored
+func (c *HeatmapCache) InvalidateOpen() {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*heatmapCacheEntry).open {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testcacheregionpath = "../test/cache_region"
+	testcachetablepath  = "../test/cache_table"
+)
+
+func TestNormaliseTimeRange(t *testing.T) {
+	start, end := normaliseTimeRange(time.Unix(1574000030, 0), time.Unix(1574000090, 0))
+	if start.Unix() != 1573999980 || end.Unix() != 1574000100 {
+		t.Fatalf("error time range %d %d", start.Unix(), end.Unix())
+	}
+	// a time on the interval is kept
+	start, end = normaliseTimeRange(time.Unix(1573999980, 0), time.Unix(1574000040, 0))
+	if start.Unix() != 1573999980 || end.Unix() != 1574000040 {
+		t.Fatalf("error time range %d %d", start.Unix(), end.Unix())
+	}
+}
+
+func TestHeatmapCache(t *testing.T) {
+	// the cache depends on the latest stored axis, so the axes of the last run are removed
+	perr(os.RemoveAll(testcacheregionpath))
+	globalRegionStore.LeveldbStorage, _ = NewLeveldbStorage(testcacheregionpath)
+	defer globalRegionStore.LeveldbStorage.Close()
+	openTestTables(testcachetablepath)
+	defer tables.LeveldbStorage.Close()
+	defer func(size int) { *cacheSize = size }(*cacheSize)
+	*cacheSize = 3
+
+	start := time.Unix(1573999980, 0)
+	save := func(i int) {
+		axis := &DiscreteAxis{
+			EndTime: start.Add(time.Duration(i) * time.Minute),
+			Lines: []*Line{
+				{EndKey: GenTablePrefix(45), RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, 1, 0))},
+				{EndKey: "~", RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, uint64(i+2), 0))},
+			},
+		}
+		value, err := json.Marshal(axis)
+		perr(err)
+		perr(globalRegionStore.Save(timeKey(axis.EndTime), value))
+	}
+	for i := 0; i < 3; i++ {
+		save(i)
+	}
+
+	cache := newHeatmapCache()
+	closed := cache.Generate(start, start.Add(time.Minute), "", "~", "read_bytes", "")
+	if closed == nil || closed != cache.Generate(start.Add(time.Second), start.Add(50*time.Second), "", "~", "read_bytes", "") {
+		t.Fatalf("the queries in the same intervals should share the heatmap")
+	}
+	// the heatmap reaching beyond the latest axis is generated from a sliding window, which is also cached
+	open := cache.Generate(start, start.Add(4*time.Minute), "", "~", "read_bytes", "")
+	if open == nil || open == closed || len(cache.entries) != 3 {
+		t.Fatalf("error cache entries %v", cache.entries)
+	}
+	if full := GenerateHeatmap(start, start.Add(4*time.Minute), "", "~", "read_bytes", ""); !reflect.DeepEqual(open, full) {
+		t.Fatalf("the heatmap of the new sliding window should be the same as the full one")
+	}
+
+	// only the heatmaps reaching beyond the latest axis are invalidated by a new axis
+	save(3)
+	cache.InvalidateOpen()
+	if cache.Generate(start, start.Add(time.Minute), "", "~", "read_bytes", "") != closed {
+		t.Fatalf("the closed heatmap should be kept")
+	}
+	if hmap := cache.Generate(start, start.Add(4*time.Minute), "", "~", "read_bytes", ""); hmap == open || len(hmap.Times) != len(open.Times)+1 {
+		t.Fatalf("the open heatmap should be regenerated")
+	}
+	// the sliding window is moved forward
+	windows := 0
+	for _, elem := range cache.entries {
+		if window := elem.Value.(*heatmapCacheEntry).window; window != nil {
+			windows++
+			if !window.EndTime().Equal(start.Add(3 * time.Minute)) {
+				t.Fatalf("the sliding window should be moved to the new axis")
+			}
+		}
+	}
+	if windows != 1 || len(cache.entries) != 3 {
+		t.Fatalf("error cache entries %v", cache.entries)
+	}
+
+	// the least recently used heatmap is evicted
+	cache.Generate(start, start.Add(2*time.Minute), "", "~", "read_bytes", "")
+	if len(cache.entries) != 3 || cache.Generate(start, start.Add(time.Minute), "", "~", "read_bytes", "") == closed {
+		t.Fatalf("the least recently used heatmap should be evicted")
+	}
+
+	// a heatmap is regenerated after the tables change
+	closed = cache.Generate(start, start.Add(time.Minute), "", "~", "read_bytes", "")
+	saveTestTables(&Table{Name: "orders", DB: "sales", ID: 45})
+	if cache.Generate(start, start.Add(time.Minute), "", "~", "read_bytes", "") == closed {
+		t.Fatalf("the heatmap should be regenerated with the new tables")
+	}
+
+	// a window starting later than the query by more than a column is rebuilt
+	cache = newHeatmapCache()
+	cache.Generate(start.Add(2*time.Minute), start.Add(6*time.Minute), "", "~", "read_bytes", "")
+	earlier := cache.Generate(start, start.Add(4*time.Minute), "", "~", "read_bytes", "")
+	if full := GenerateHeatmap(start, start.Add(4*time.Minute), "", "~", "read_bytes", ""); !reflect.DeepEqual(earlier, full) {
+		t.Fatalf("the heatmap starting earlier than the sliding window should be the same as the full one")
+	}
+
+	// concurrent queries get the same heatmap
+	cache = newHeatmapCache()
+	results := make([]*Heatmap, 8)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = cache.Generate(start, start.Add(time.Minute), "", "~", "read_bytes", "")
+		}(i)
+	}
+	wg.Wait()
+	for _, hmap := range results {
+		if hmap != results[0] {
+			t.Fatalf("concurrent queries should share the heatmap")
+		}
+	}
+}
@@ -3,7 +3,13 @@ package main
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -12,6 +18,17 @@ var (
 	indexPrefixSep  = []byte("_i")
 )
 
+// flags of datums encoded in the memcomparable format, e.g. the values of an index key
+const (
+	nilFlag      byte = 0
+	bytesFlag    byte = 1
+	intFlag      byte = 3
+	uintFlag     byte = 4
+	floatFlag    byte = 5
+	decimalFlag  byte = 6
+	durationFlag byte = 7
+)
+
 const (
 	signMask uint64 = 0x8000000000000000
 
@@ -57,6 +74,36 @@ func EncodeBytes(data []byte) []byte {
 	return result
 }
 
+// DecodeBytes decodes bytes which are encoded by EncodeBytes before,
+// returns the leftover bytes and the decoded value if no error.
+func DecodeBytes(b []byte) ([]byte, []byte, error) {
+	data := make([]byte, 0, len(b))
+	for {
+		if len(b) < encGroupSize+1 {
+			return nil, nil, errors.New("insufficient bytes to decode value")
+		}
+		group := b[:encGroupSize]
+		marker := b[encGroupSize]
+		padCount := encMarker - marker
+		if padCount > encGroupSize {
+			return nil, nil, fmt.Errorf("invalid marker byte, group bytes %q", b[:encGroupSize+1])
+		}
+		realGroupSize := encGroupSize - padCount
+		data = append(data, group[:realGroupSize]...)
+		b = b[encGroupSize+1:]
+		if padCount != 0 {
+			// check validity of padding bytes
+			for _, v := range group[realGroupSize:] {
+				if v != encPad {
+					return nil, nil, fmt.Errorf("invalid padding byte, group bytes %q", group)
+				}
+			}
+			break
+		}
+	}
+	return b, data, nil
+}
+
 // EncodeIntToCmpUint make int v to comparable uint type
 func EncodeIntToCmpUint(v int64) uint64 {
 	return uint64(v) ^ signMask
@@ -71,6 +118,170 @@ func EncodeInt(b []byte, v int64) []byte {
 	return append(b, data[:]...)
 }
 
+// DecodeCmpUintToInt decodes the u that encoded by EncodeIntToCmpUint
+func DecodeCmpUintToInt(u uint64) int64 {
+	return int64(u ^ signMask)
+}
+
+// DecodeInt decodes value encoded by EncodeInt before.
+// It returns the leftover un-decoded slice, decoded value if no error.
+func DecodeInt(b []byte) ([]byte, int64, error) {
+	if len(b) < 8 {
+		return nil, 0, errors.New("insufficient bytes to decode value")
+	}
+	u := binary.BigEndian.Uint64(b[:8])
+	return b[8:], DecodeCmpUintToInt(u), nil
+}
+
+// decodeUint decodes an unsigned integer in big endian order
+func decodeUint(b []byte) ([]byte, uint64, error) {
+	if len(b) < 8 {
+		return nil, 0, errors.New("insufficient bytes to decode value")
+	}
+	return b[8:], binary.BigEndian.Uint64(b[:8]), nil
+}
+
+// decodeFloat decodes a float64 encoded in the memcomparable format
+func decodeFloat(b []byte) ([]byte, float64, error) {
+	b, u, err := decodeUint(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if u&signMask > 0 {
+		u &= ^signMask
+	} else {
+		u = ^u
+	}
+	return b, math.Float64frombits(u), nil
+}
+
+// the amount of bytes of the decimal digits in a word of the binary decimal format
+var dig2bytes = [10]int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+
+const digitsPerWord = 9
+
+// decodeDecimal decodes a decimal encoded as the precision, the frac and the binary format of MySQL,
+// in which the integer and the fraction parts are stored in words of 9 digits, the sign bit is flipped,
+// and all the bits of a negative decimal are inverted.
+func decodeDecimal(b []byte) ([]byte, json.Number, error) {
+	if len(b) < 2 {
+		return nil, "", errors.New("insufficient bytes to decode decimal")
+	}
+	precision, frac := int(b[0]), int(b[1])
+	if frac > precision {
+		return nil, "", errors.New("invalid decimal")
+	}
+	b = b[2:]
+	intg := precision - frac
+	words := []int{dig2bytes[intg%digitsPerWord]}
+	for i := 0; i < intg/digitsPerWord; i++ {
+		words = append(words, 4)
+	}
+	intWords := len(words)
+	for i := 0; i < frac/digitsPerWord; i++ {
+		words = append(words, 4)
+	}
+	words = append(words, dig2bytes[frac%digitsPerWord])
+	size := 0
+	for _, n := range words {
+		size += n
+	}
+	if size == 0 || len(b) < size {
+		return nil, "", errors.New("insufficient bytes to decode decimal")
+	}
+	bin := append([]byte(nil), b[:size]...)
+	var mask byte
+	if bin[0]&0x80 == 0 {
+		mask = 0xFF
+	}
+	bin[0] ^= 0x80
+
+	var intPart, fracPart strings.Builder
+	for i, n := range words {
+		var word uint64
+		for _, c := range bin[:n] {
+			word = word<<8 | uint64(c^mask)
+		}
+		bin = bin[n:]
+		switch {
+		case n == 0:
+		case i < intWords:
+			fmt.Fprintf(&intPart, "%0*d", digitsPerWord, word)
+		case i == len(words)-1:
+			fmt.Fprintf(&fracPart, "%0*d", frac%digitsPerWord, word)
+		default:
+			fmt.Fprintf(&fracPart, "%0*d", digitsPerWord, word)
+		}
+	}
+	s := strings.TrimLeft(intPart.String(), "0")
+	if s == "" {
+		s = "0"
+	}
+	if fracPart.Len() > 0 {
+		s += "." + fracPart.String()
+	}
+	if mask != 0 {
+		s = "-" + s
+	}
+	return b[size:], json.Number(s), nil
+}
+
+// DecodeDatums decodes the values of an index key as far as possible,
+// it stops at the first value which is unknown or broken.
+// The decoded values are nil, string, int64, uint64, float64, json.Number of decimals or time.Duration.
+func DecodeDatums(b []byte) []interface{} {
+	values := make([]interface{}, 0)
+	for len(b) > 0 {
+		var v interface{}
+		var err error
+		flag := b[0]
+		b = b[1:]
+		switch flag {
+		case nilFlag:
+		case bytesFlag:
+			var data []byte
+			b, data, err = DecodeBytes(b)
+			v = string(data)
+		case intFlag:
+			var i int64
+			b, i, err = DecodeInt(b)
+			v = i
+		case uintFlag:
+			var u uint64
+			b, u, err = decodeUint(b)
+			v = u
+		case floatFlag:
+			var f float64
+			b, f, err = decodeFloat(b)
+			v = f
+		case decimalFlag:
+			var d json.Number
+			b, d, err = decodeDecimal(b)
+			v = d
+		case durationFlag:
+			var d int64
+			b, d, err = DecodeInt(b)
+			v = time.Duration(d)
+		default:
+			// the other types are not supported
+			return values
+		}
+		if err != nil {
+			return values
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// GenTablePrefix composes table prefix with tableID: "t[tableID]".
+func GenTablePrefix(tableID int64) string {
+	buf := make([]byte, 0, len(tablePrefix)+8)
+	buf = append(buf, tablePrefix...)
+	buf = EncodeInt(buf, tableID)
+	return strings.ToUpper(hex.EncodeToString(EncodeBytes(buf)))
+}
+
 // GenTableRecordPrefix composes record prefix with tableID: "t[tableID]_r".
 func GenTableRecordPrefix(tableID int64) string {
 	buf := make([]byte, 0, len(tablePrefix)+8+len(recordPrefixSep))
@@ -86,6 +297,14 @@ func GenTableIndexPrefix(tableID int64, idx int64) string {
 	return strings.ToUpper(hex.EncodeToString(EncodeBytes(buf)))
 }
 
+// GenTableRowKey composes row key with tableID and handle: "t[tableID]_r[handle]".
+func GenTableRowKey(tableID int64, handle int64) string {
+	buf := make([]byte, 0, len(tablePrefix)+8+len(recordPrefixSep)+8)
+	buf = appendTableRecordPrefix(buf, tableID)
+	buf = EncodeInt(buf, handle)
+	return strings.ToUpper(hex.EncodeToString(EncodeBytes(buf)))
+}
+
 // appendTableRecordPrefix appends table record prefix  "t[tableID]_r".
 func appendTableRecordPrefix(buf []byte, tableID int64) []byte {
 	buf = append(buf, tablePrefix...)
@@ -101,3 +320,145 @@ func appendTableIndexPrefix(buf []byte, tableID int64) []byte {
 	buf = append(buf, indexPrefixSep...)
 	return buf
 }
+
+// KeyInfo is the TiDB meaning of a region boundary key
+type KeyInfo struct {
+	TableID      int64         `json:"table_id"`
+	IsRecord     bool          `json:"is_record"`               // the key belongs to the data of the table
+	Handle       *int64        `json:"handle,omitempty"`        // the int handle of the row if IsRecord
+	CommonHandle []interface{} `json:"common_handle,omitempty"` // the primary key of the row if IsRecord and the table is clustered
+	IsIndex      bool          `json:"is_index"`                // the key belongs to an index of the table
+	IndexID      *int64        `json:"index_id,omitempty"`      // the ID of the index if IsIndex
+	IndexValues  []interface{} `json:"index_values,omitempty"`  // the decoded values of the index if IsIndex
+	Rest         []byte        `json:"-"`                       // the bytes that cannot be parsed
+}
+
+// CommonHandleLookup tells whether the table of a physical ID is clustered, known is false if the table is unknown
+type CommonHandleLookup func(tableID int64) (isCommonHandle bool, known bool)
+
+// ParseKey parses a region boundary key, which is the uppercase hex of a memcomparable-encoded key.
+// The record keys are decoded by the handle kind of the table given by lookup, which can be nil,
+// or guessed by isCommonHandle if the table is unknown. It returns nil if the key is not a key of a TiDB table.
+func ParseKey(key string, lookup CommonHandleLookup) *KeyInfo {
+	raw, err := decodeRegionKey(key)
+	if err != nil || len(raw) < len(tablePrefix)+8 || string(raw[:len(tablePrefix)]) != string(tablePrefix) {
+		return nil
+	}
+	b, tableID, _ := DecodeInt(raw[len(tablePrefix):])
+	info := &KeyInfo{TableID: tableID}
+	if len(b) < len(recordPrefixSep) {
+		info.Rest = b
+		return info
+	}
+	switch string(b[:len(recordPrefixSep)]) {
+	case string(recordPrefixSep):
+		info.IsRecord = true
+		b = b[len(recordPrefixSep):]
+		commonHandle, known := false, false
+		if lookup != nil {
+			commonHandle, known = lookup(tableID)
+		}
+		if !known {
+			commonHandle = isCommonHandle(b)
+		}
+		if commonHandle && len(b) > 0 {
+			info.CommonHandle = DecodeDatums(b)
+			b = nil
+		} else if leftover, handle, err := DecodeInt(b); err == nil {
+			info.Handle = &handle
+			b = leftover
+		}
+	case string(indexPrefixSep):
+		info.IsIndex = true
+		b = b[len(indexPrefixSep):]
+		if leftover, indexID, err := DecodeInt(b); err == nil {
+			info.IndexID = &indexID
+			info.IndexValues = DecodeDatums(leftover)
+			b = nil
+		}
+	}
+	if len(b) > 0 {
+		info.Rest = b
+	}
+	return info
+}
+
+// isCommonHandle guesses whether the record part of a key of an unknown table is a common handle,
+// which starts with a datum flag, while an int handle starts with 0x80 or 0x7F unless it is extremely large.
+func isCommonHandle(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	switch b[0] {
+	case bytesFlag, intFlag, uintFlag, floatFlag, decimalFlag, durationFlag:
+		return true
+	}
+	return false
+}
+
+// decodeRegionKey converts a region boundary key into the raw key
+func decodeRegionKey(key string) ([]byte, error) {
+	encoded, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	_, raw, err := DecodeBytes(encoded)
+	return raw, err
+}
+
+// String returns a human-readable form of the key, e.g. "t_45_r_100923" or "t_45_i_1_\"abc\"_123"
+func (info *KeyInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "t_%d", info.TableID)
+	if info.IsRecord {
+		b.WriteString("_r")
+		if info.Handle != nil {
+			fmt.Fprintf(&b, "_%d", *info.Handle)
+		}
+		for _, v := range info.CommonHandle {
+			b.WriteString("_")
+			b.WriteString(formatDatum(v))
+		}
+	}
+	if info.IsIndex {
+		b.WriteString("_i")
+		if info.IndexID != nil {
+			fmt.Fprintf(&b, "_%d", *info.IndexID)
+		}
+		for _, v := range info.IndexValues {
+			b.WriteString("_")
+			b.WriteString(formatDatum(v))
+		}
+	}
+	if len(info.Rest) > 0 {
+		b.WriteString("_")
+		b.WriteString(strings.ToUpper(hex.EncodeToString(info.Rest)))
+	}
+	return b.String()
+}
+
+func formatDatum(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return strconv.Quote(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// DecodeKey returns a human-readable form of a region boundary key.
+// Keys of TiDB tables are shown like "t_45_r_100923", the other keys are shown as quoted raw keys,
+// and the key is returned as it is if it cannot be decoded. The record keys are decoded as ParseKey does.
+func DecodeKey(key string, lookup CommonHandleLookup) string {
+	if info := ParseKey(key, lookup); info != nil {
+		return info.String()
+	}
+	if raw, err := decodeRegionKey(key); err == nil {
+		return strconv.Quote(string(raw))
+	}
+	return key
+}
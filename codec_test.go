@@ -1,6 +1,9 @@
 package main
 
 import (
+	"encoding/hex"
+	"math"
+	"strings"
 	"testing"
 )
 
@@ -49,3 +52,123 @@ func TestAppendTableIndexPrefix(t *testing.T) {
 		t.Fatalf("error TestAppendTableIndexPrefix")
 	}
 }
+func TestGenTablePrefix(t *testing.T) {
+	if GenTablePrefix(1) != "7480000000000000FF0100000000000000F8" {
+		t.Fatalf("error GenTablePrefix, expect 7480000000000000FF0100000000000000F8 but get %s", GenTablePrefix(1))
+	}
+	if GenTablePrefix(1) >= GenTableRecordPrefix(1) || GenTableIndexPrefix(1, 1) >= GenTableRecordPrefix(1) ||
+		GenTableRecordPrefix(1) >= GenTablePrefix(2) {
+		t.Fatalf("error GenTablePrefix order")
+	}
+}
+func TestGenTableRowKey(t *testing.T) {
+	if GenTableRowKey(1, 2) != "7480000000000000FF015F728000000000FF0000020000000000FA" {
+		t.Fatalf("error GenTableRowKey, get %s", GenTableRowKey(1, 2))
+	}
+	if GenTableRowKey(1, 2) <= GenTableRecordPrefix(1) || GenTableRowKey(1, 2) >= GenTableRowKey(1, 3) {
+		t.Fatalf("error GenTableRowKey order")
+	}
+}
+func TestDecodeBytes(t *testing.T) {
+	for _, data := range []string{"", "aaa", "12345678", "123456789abcdefgh"} {
+		encoded := EncodeBytes([]byte(data))
+		leftover, decoded, err := DecodeBytes(append(encoded, 'x'))
+		if err != nil || string(decoded) != data || string(leftover) != "x" {
+			t.Fatalf("error DecodeBytes %q, get %q, leftover %q, %v", data, decoded, leftover, err)
+		}
+	}
+	if _, _, err := DecodeBytes([]byte{1, 2, 3}); err == nil {
+		t.Fatalf("expect error when bytes are insufficient")
+	}
+	if _, _, err := DecodeBytes([]byte{1, 2, 3, 0, 0, 0, 0, 1, 250}); err == nil {
+		t.Fatalf("expect error when padding bytes are invalid")
+	}
+}
+func TestDecodeInt(t *testing.T) {
+	for _, v := range []int64{0, 1, -1, 100923, -9223372036854775808, 9223372036854775807} {
+		leftover, result, err := DecodeInt(EncodeInt(nil, v))
+		if err != nil || result != v || len(leftover) != 0 {
+			t.Fatalf("error DecodeInt %d, get %d", v, result)
+		}
+	}
+}
+func TestParseKey(t *testing.T) {
+	buf := appendTableIndexPrefix(nil, 45)
+	buf = EncodeInt(buf, 1)
+	buf = append(buf, bytesFlag)
+	buf = append(buf, EncodeBytes([]byte("abc"))...)
+	buf = append(buf, intFlag)
+	buf = EncodeInt(buf, -123)
+	indexKey := strings.ToUpper(hex.EncodeToString(EncodeBytes(buf)))
+
+	cases := []struct {
+		key    string
+		expect string
+	}{
+		{GenTablePrefix(45), "t_45"},
+		{GenTableRecordPrefix(45), "t_45_r"},
+		{GenTableRowKey(45, 100923), "t_45_r_100923"},
+		{GenTableIndexPrefix(45, 1), "t_45_i_1"},
+		{indexKey, `t_45_i_1_"abc"_-123`},
+	}
+	for _, c := range cases {
+		info := ParseKey(c.key, nil)
+		if info == nil || info.String() != c.expect || DecodeKey(c.key, nil) != c.expect {
+			t.Fatalf("error ParseKey %s, expect %s but get %v", c.key, c.expect, info)
+		}
+	}
+	buf = appendTableRecordPrefix(nil, 45)
+	buf = append(buf, bytesFlag)
+	buf = append(buf, EncodeBytes([]byte("pk"))...)
+	commonHandleKey := strings.ToUpper(hex.EncodeToString(EncodeBytes(buf)))
+	if info := ParseKey(commonHandleKey, nil); info == nil || info.Handle != nil || info.String() != `t_45_r_"pk"` {
+		t.Fatalf("error ParseKey common handle %s, get %v", commonHandleKey, info)
+	}
+
+	// a clustered table with a DECIMAL primary key, 12.34 and -1234567890.5 of DECIMAL(12, 2)
+	for _, c := range []struct {
+		bin    []byte
+		expect string
+	}{
+		{[]byte{0x80, 0x00, 0x00, 0x00, 0x0C, 0x22}, `t_45_r_12.34`},
+		{[]byte{0x7E, 0xF2, 0x04, 0xC7, 0x2D, 0xCD}, `t_45_r_-1234567890.50`},
+	} {
+		buf = appendTableRecordPrefix(nil, 45)
+		buf = append(buf, decimalFlag, 12, 2)
+		buf = append(buf, c.bin...)
+		key := strings.ToUpper(hex.EncodeToString(EncodeBytes(buf)))
+		if info := ParseKey(key, nil); info == nil || info.Handle != nil || info.String() != c.expect {
+			t.Fatalf("error ParseKey decimal common handle %s, expect %s but get %v", key, c.expect, info)
+		}
+	}
+
+	// the handle kind of a known table is given by the schema instead of the first byte of the handle,
+	// e.g. the int handle math.MinInt64+3<<56 starts with the flag of an int datum
+	rowKey := GenTableRowKey(45, math.MinInt64+3<<56)
+	lookup := func(tableID int64) (bool, bool) { return false, tableID == 45 }
+	if info := ParseKey(rowKey, nil); info == nil || info.Handle != nil {
+		t.Fatalf("expect the handle is guessed as a common handle, get %v", info)
+	}
+	if info := ParseKey(rowKey, lookup); info == nil || info.Handle == nil || *info.Handle != math.MinInt64+3<<56 {
+		t.Fatalf("error ParseKey int handle of a known table %s, get %v", rowKey, info)
+	}
+	lookup = func(tableID int64) (bool, bool) { return true, true }
+	if info := ParseKey(commonHandleKey, lookup); info == nil || info.Handle != nil || info.String() != `t_45_r_"pk"` {
+		t.Fatalf("error ParseKey common handle of a known table %s, get %v", commonHandleKey, info)
+	}
+
+	info := ParseKey(indexKey, nil)
+	if !info.IsIndex || *info.IndexID != 1 || len(info.IndexValues) != 2 || info.IndexValues[0] != "abc" || info.IndexValues[1] != int64(-123) {
+		t.Fatalf("error ParseKey index values %v", info.IndexValues)
+	}
+
+	meta := strings.ToUpper(hex.EncodeToString(EncodeBytes([]byte("mDDLJobList"))))
+	if ParseKey(meta, nil) != nil || DecodeKey(meta, nil) != `"mDDLJobList"` {
+		t.Fatalf("error DecodeKey %s, get %s", meta, DecodeKey(meta, nil))
+	}
+	for _, key := range []string{"", "~", "a"} {
+		if ParseKey(key, nil) != nil || DecodeKey(key, nil) != key {
+			t.Fatalf("error DecodeKey %q, get %q", key, DecodeKey(key, nil))
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the prefix of the environment variables which override the settings, e.g. KEYVISUAL_PD overrides -pd
+const envPrefix = "KEYVISUAL_"
+
+// the settings which can be changed on SIGHUP, the others are structural and need a restart.
+// A reloadable setting is only read by the collecting loop, which does the reload, or is guarded by a lock.
+// max-display-times and max-display-keys are not reloadable, since they are read by the concurrent requests.
+var reloadableFlags = map[string]bool{
+	"pd":                  true,
+	"tidb":                true,
+	"hotspot-threshold":   true,
+	"hotspot-ratio":       true,
+	"label-rules":         true,
+	"alert-rules":         true,
+	"metrics-table-limit": true,
+	"retention":           true,
+	"auth-tokens":         true,
+}
+
+// the flags given on the command line, which take precedence over the config file and the environment variables
+var explicitFlags = make(map[string]bool)
+
+// reloads is signaled on SIGHUP. The reload is done by the collecting loop, which reads the reloadable settings.
+var reloads = make(chan struct{}, 1)
+
+// envName returns the environment variable of a flag, e.g. KEYVISUAL_SCHEMA_INTERVAL of -schema-interval
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// readConfigFile reads the config file into the values of flags. TOML is used if the extension is .toml,
+// otherwise YAML, which also accepts JSON. The nested tables are flattened by joining the keys with "-",
+// e.g. cert in the tls table sets -tls-cert, and the lists are joined with ",".
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var root interface{}
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		var table map[string]interface{}
+		_, err = toml.Decode(string(data), &table)
+		root = table
+	} else {
+		err = yaml.Unmarshal(data, &root)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %s", path, err.Error())
+	}
+	settings := make(map[string]string)
+	switch root.(type) {
+	case nil:
+		return settings, nil
+	case map[string]interface{}, map[interface{}]interface{}:
+	default:
+		return nil, fmt.Errorf("parse %s: expect a table of settings", path)
+	}
+	if err := flattenConfig("", root, settings); err != nil {
+		return nil, fmt.Errorf("parse %s: %s", path, err.Error())
+	}
+	return settings, nil
+}
+
+func flattenConfig(prefix string, v interface{}, settings map[string]string) error {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "-" + key
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if err := flattenConfig(join(key), value, settings); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for key, value := range v {
+			if err := flattenConfig(join(fmt.Sprint(key)), value, settings); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			switch item.(type) {
+			case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+				return fmt.Errorf("%s: expect a list of values", prefix)
+			}
+			items[i] = fmt.Sprint(item)
+		}
+		settings[prefix] = strings.Join(items, ",")
+	case nil:
+		settings[prefix] = ""
+	default:
+		settings[prefix] = fmt.Sprint(v)
+	}
+	return nil
+}
+
+// configSettings reads the values of flags from the config file given by -config and the environment variables,
+// the latter take precedence
+func configSettings(fs *flag.FlagSet) (map[string]string, error) {
+	settings := make(map[string]string)
+	if path := fs.Lookup("config").Value.String(); path != "" {
+		var err error
+		if settings, err = readConfigFile(path); err != nil {
+			return nil, err
+		}
+		for name := range settings {
+			if fs.Lookup(name) == nil || name == "config" {
+				return nil, fmt.Errorf("%s: unknown setting %q", path, name)
+			}
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok && f.Name != "config" {
+			settings[f.Name] = value
+		}
+	})
+	return settings, nil
+}
+
+// loadConfig sets the flags which are not given on the command line from the config file and the environment
+// variables, it should be called after fs is parsed
+func loadConfig(fs *flag.FlagSet) error {
+	fs.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+	if path, ok := os.LookupEnv(envName("config")); ok && !explicitFlags["config"] {
+		if err := fs.Set("config", path); err != nil {
+			return err
+		}
+	}
+	settings, err := configSettings(fs)
+	if err != nil {
+		return err
+	}
+	for name, value := range settings {
+		if explicitFlags[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %s", value, name, err.Error())
+		}
+	}
+	return checkSettings(fs)
+}
+
+// reloadSettings reads the config file and the environment variables again, and changes the reloadable flags.
+// A reloadable flag missing from both is reset to its default. The names of the changed flags are returned,
+// and nothing is changed if any value is invalid.
+func reloadSettings(fs *flag.FlagSet) ([]string, error) {
+	settings, err := configSettings(fs)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := settings[f.Name]
+		if !ok {
+			value = f.DefValue
+		}
+		// the config file itself is not changed by reloading
+		if f.Name == "config" || explicitFlags[f.Name] || sameValue(f, value) {
+			return
+		}
+		if !reloadableFlags[f.Name] {
+			log.Printf("%s is changed, which needs a restart", f.Name)
+			return
+		}
+		values[f.Name] = value
+	})
+	// the pool of TiDB servers reads -tidb with tidbPoolMu held
+	tidbPoolMu.Lock()
+	defer tidbPoolMu.Unlock()
+	changed := make([]string, 0, len(values))
+	old := make(map[string]string)
+	for name, value := range values {
+		old[name] = fs.Lookup(name).Value.String()
+		changed = append(changed, name)
+		if err = fs.Set(name, value); err != nil {
+			err = fmt.Errorf("invalid value %q for %s: %s", value, name, err.Error())
+			break
+		}
+	}
+	if err == nil {
+		err = checkSettings(fs)
+	}
+	if err != nil {
+		// roll back, the old values are always valid
+		for name, value := range old {
+			perr(fs.Set(name, value))
+		}
+		return nil, err
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// loadRules loads the label rules and the alert rules from their files if given
+func loadRules() error {
+	if *labelRulePath != "" {
+		if err := labelRules.Load(*labelRulePath); err != nil {
+			return err
+		}
+	}
+	if *alertRulePath != "" {
+		if err := alertRules.Load(*alertRulePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadRules loads the label rules and the alert rules again, the rules whose path becomes empty are cleared
+func reloadRules() {
+	if err := labelRules.Reload(*labelRulePath); err != nil {
+		log.Printf("reload label rules: %s", err.Error())
+	}
+	if err := alertRules.Reload(*alertRulePath); err != nil {
+		log.Printf("reload alert rules: %s", err.Error())
+	}
+}
+
+// reloadConfig changes the reloadable settings, and reloads the tokens and the rule files, which may have been
+// edited even if their paths are not changed
+func reloadConfig() {
+	changed, err := reloadSettings(flag.CommandLine)
+	if err != nil {
+		log.Printf("reload config: %s", err.Error())
+		return
+	}
+	log.Printf("config reloaded, changed settings: [%s]", strings.Join(changed, ", "))
+	apiTokens.set(*authTokens)
+	reloadRules()
+}
+
+// sameValue returns whether value is parsed into the current value of f, e.g. 1m is the same as 1m0s
+func sameValue(f *flag.Flag, value string) bool {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return value == f.Value.String()
+	}
+	switch current := getter.Get().(type) {
+	case time.Duration:
+		v, err := time.ParseDuration(value)
+		return err == nil && v == current
+	case int:
+		v, err := strconv.ParseInt(value, 0, 64)
+		return err == nil && v == int64(current)
+	case uint64:
+		v, err := strconv.ParseUint(value, 0, 64)
+		return err == nil && v == current
+	case float64:
+		v, err := strconv.ParseFloat(value, 64)
+		return err == nil && v == current
+	case bool:
+		v, err := strconv.ParseBool(value)
+		return err == nil && v == current
+	}
+	return value == f.Value.String()
+}
+
+// checkSettings validates the values of the flags which can not be checked by parsing
+func checkSettings(fs *flag.FlagSet) error {
+	for _, name := range []string{"max-display-times", "max-display-keys", "schema-concurrency"} {
+		if f := fs.Lookup(name); f != nil && f.Value.(flag.Getter).Get().(int) <= 0 {
+			return fmt.Errorf("%s should be positive", name)
+		}
+	}
+	// the intervals are used by tickers, which do not accept a non-positive duration
+	for _, name := range []string{"I", "schema-interval"} {
+		if f := fs.Lookup(name); f != nil && f.Value.(flag.Getter).Get().(time.Duration) <= 0 {
+			return fmt.Errorf("%s should be positive", name)
+		}
+	}
+	if f := fs.Lookup("retention"); f != nil && f.Value.(flag.Getter).Get().(time.Duration) < 0 {
+		return errors.New("retention should not be negative")
+	}
+	cert, key := fs.Lookup("tls-cert"), fs.Lookup("tls-key")
+	if cert != nil && key != nil && (cert.Value.String() == "") != (key.Value.String() == "") {
+		return errors.New("tls-cert and tls-key should be given together")
+	}
+	return nil
+}
+
+// loadTLS makes the requests to PD, TiDB and the webhooks verify the servers with -tls-ca in addition to the
+// system CAs, and present -tls-cert if it is requested. The returned config is used to serve HTTPS,
+// which is nil if no certificate is given.
+func loadTLS() (*tls.Config, error) {
+	if *tlsCA == "" && *tlsCert == "" {
+		return nil, nil
+	}
+	clientConfig := &tls.Config{}
+	if *tlsCA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate in %s", *tlsCA)
+		}
+		clientConfig.RootCAs = pool
+	}
+	var serverConfig *tls.Config
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		clientConfig.Certificates = []tls.Certificate{cert}
+		serverConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = clientConfig
+	httpClient.Transport = transport
+	return serverConfig, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testconfigpath = "../test/config"
+
+// newTestFlagSet returns the flags used in the tests of config
+func newTestFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("config", "", "")
+	fs.String("addr", "0.0.0.0:8000", "")
+	fs.String("pd", "http://127.0.0.1:2379", "")
+	fs.String("tidb", "", "")
+	fs.Duration("I", time.Minute, "")
+	fs.Duration("schema-interval", time.Minute, "")
+	fs.Duration("retention", 0, "")
+	fs.Int("max-display-times", 50, "")
+	fs.Int("schema-concurrency", 4, "")
+	fs.String("tls-cert", "", "")
+	fs.String("tls-key", "", "")
+	return fs
+}
+
+func writeTestConfig(name string, content string) string {
+	perr(os.MkdirAll(testconfigpath, 0755))
+	path := filepath.Join(testconfigpath, name)
+	perr(ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestReadConfigFile(t *testing.T) {
+	expect := map[string]string{
+		"addr":      "0.0.0.0:9000",
+		"I":         "30s",
+		"tidb":      "http://a:10080,http://b:10080",
+		"tls-cert":  "server.pem",
+		"tls-key":   "server-key.pem",
+		"retention": "168h",
+	}
+	files := map[string]string{
+		"keyvisual.toml": `
+addr = "0.0.0.0:9000"
+I = "30s"
+tidb = ["http://a:10080", "http://b:10080"]
+retention = "168h"
+
+[tls]
+cert = "server.pem"
+key = "server-key.pem"
+`,
+		"keyvisual.yaml": `
+addr: 0.0.0.0:9000
+I: 30s
+tidb: [http://a:10080, http://b:10080]
+retention: 168h
+tls:
+  cert: server.pem
+  key: server-key.pem
+`,
+		"keyvisual.json": `{"addr": "0.0.0.0:9000", "I": "30s", "tidb": ["http://a:10080", "http://b:10080"],
+"retention": "168h", "tls": {"cert": "server.pem", "key": "server-key.pem"}}`,
+	}
+	for name, content := range files {
+		settings, err := readConfigFile(writeTestConfig(name, content))
+		if err != nil || !reflect.DeepEqual(settings, expect) {
+			t.Fatalf("%s: expect %v, but got %v %v", name, expect, settings, err)
+		}
+	}
+	if _, err := readConfigFile(writeTestConfig("list.yaml", "- a\n- b\n")); err == nil {
+		t.Fatalf("expect error for a config which is not a table")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	defer func(flags map[string]bool) { explicitFlags = flags }(explicitFlags)
+	explicitFlags = make(map[string]bool)
+	path := writeTestConfig("load.toml", "addr = \"0.0.0.0:9000\"\npd = \"http://file:2379\"\nI = \"30s\"\nretention = \"1h\"\n")
+	perr(os.Setenv("KEYVISUAL_CONFIG", path))
+	defer os.Unsetenv("KEYVISUAL_CONFIG")
+	perr(os.Setenv("KEYVISUAL_PD", "http://env:2379"))
+	defer os.Unsetenv("KEYVISUAL_PD")
+
+	// the command line takes precedence over the environment variables, which take precedence over the file
+	fs := newTestFlagSet()
+	perr(fs.Parse([]string{"-addr", "127.0.0.1:8000"}))
+	perr(loadConfig(fs))
+	for name, expect := range map[string]string{"addr": "127.0.0.1:8000", "pd": "http://env:2379", "I": "30s", "retention": "1h0m0s"} {
+		if value := fs.Lookup(name).Value.String(); value != expect {
+			t.Fatalf("%s: expect %s, but got %s", name, expect, value)
+		}
+	}
+
+	// the reloadable settings are changed, or reset if they are removed, the others are kept
+	perr(ioutil.WriteFile(path, []byte("addr = \"0.0.0.0:9001\"\ntidb = \"http://tidb:10080\"\nI = \"30s\"\n"), 0644))
+	changed, err := reloadSettings(fs)
+	perr(err)
+	if !reflect.DeepEqual(changed, []string{"retention", "tidb"}) {
+		t.Fatalf("error changed settings %v", changed)
+	}
+	for name, expect := range map[string]string{"addr": "127.0.0.1:8000", "tidb": "http://tidb:10080", "I": "30s", "retention": "0s"} {
+		if value := fs.Lookup(name).Value.String(); value != expect {
+			t.Fatalf("%s: expect %s, but got %s", name, expect, value)
+		}
+	}
+
+	// an invalid value changes nothing
+	perr(ioutil.WriteFile(path, []byte("tidb = \"http://other:10080\"\nretention = \"-1h\"\n"), 0644))
+	if _, err := reloadSettings(fs); err == nil || fs.Lookup("tidb").Value.String() != "http://tidb:10080" {
+		t.Fatalf("expect the invalid config is rejected, but got %v", err)
+	}
+
+	for _, content := range []string{
+		"unknown = 1\n",
+		"max-display-times = 0\n",
+		"[tls]\ncert = \"server.pem\"\n",
+		"schema-concurrency = 0\n",
+		"schema-concurrency = -1\n",
+		"I = \"0s\"\n",
+		"schema-interval = \"-1m\"\n",
+	} {
+		explicitFlags = make(map[string]bool)
+		perr(ioutil.WriteFile(path, []byte(content), 0644))
+		if err := loadConfig(newTestFlagSet()); err == nil {
+			t.Fatalf("%s: expect error", content)
+		}
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	defer apiTokens.set("")
+	handler := authHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	check := func(target string, header string, expect int) {
+		r := httptest.NewRequest("GET", target, nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		if recorder.Code != expect {
+			t.Fatalf("%s %s: expect %d, but got %d", target, header, expect, recorder.Code)
+		}
+	}
+	// authentication is disabled without tokens
+	check("/heatmaps", "", 200)
+	apiTokens.set("secret, other")
+	check("/heatmaps", "", 401)
+	check("/heatmaps", "Bearer wrong", 401)
+	check("/heatmaps", "Bearer other", 200)
+	check("/heatmaps/stream?access_token=secret", "", 200)
+}
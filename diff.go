@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"github.com/HunDunDM/key-visual/matrix"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	diffHotter = "hotter"
+	diffColder = "colder"
+
+	// a bucket is highlighted if its value changes by at least diffRatio times,
+	// and the change is at least diffMinShare of the biggest value of the buckets
+	diffRatio    = 2
+	diffMinShare = 0.1
+)
+
+// TimeWindow is a time range of a diff
+type TimeWindow struct {
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+// DiffBucket is a key range of the unified key axis of a diff.
+// Base and Compare are the average values per interval of the two windows,
+// and Relative is nil if the base value is zero.
+type DiffBucket struct {
+	StartKey string      `json:"start_key"`
+	EndKey   string      `json:"end_key"`
+	Labels   []*KeyLabel `json:"labels"`
+	Base     uint64      `json:"base"`
+	Compare  uint64      `json:"compare"`
+	Diff     int64       `json:"diff"` // Compare - Base
+	Relative *float64    `json:"relative"`
+	Change   string      `json:"change,omitempty"` // "hotter" or "colder" if the bucket is highlighted
+}
+
+// HeatmapDiff is the difference of the traffic distribution between two time windows
+type HeatmapDiff struct {
+	Tag     string        `json:"tag"`
+	Base    TimeWindow    `json:"base"`
+	Compare TimeWindow    `json:"compare"`
+	Buckets []*DiffBucket `json:"buckets"`
+	// the highlighted buckets, ordered by the absolute value of Diff from the biggest
+	Highlights []*DiffBucket `json:"highlights"`
+}
+
+// compactWindow merges the axes in a window into one axis, and returns the amount of merged axes
+func compactWindow(window TimeWindow, startKey string, endKey string, tag string) (*matrix.DiscreteAxis, int) {
+	plane := rangePlane(window.StartTime, window.EndTime, startKey, endKey, tag, "average")
+	if plane == nil {
+		return &matrix.DiscreteAxis{}, 0
+	}
+	axis, _ := plane.Compact()
+	return axis, len(plane.Axes)
+}
+
+// GenerateDiff projects the two windows onto a unified key axis of at most *maxDisplayKeys buckets,
+// and compares the average values per interval of each bucket
+func GenerateDiff(base TimeWindow, compare TimeWindow, startKey string, endKey string, tag string) *HeatmapDiff {
+	diff := &HeatmapDiff{
+		Tag:        tag,
+		Base:       base,
+		Compare:    compare,
+		Buckets:    make([]*DiffBucket, 0),
+		Highlights: make([]*DiffBucket, 0),
+	}
+	baseAxis, baseCount := compactWindow(base, startKey, endKey, tag)
+	compareAxis, compareCount := compactWindow(compare, startKey, endKey, tag)
+	unified, _ := (&matrix.DiscretePlane{Axes: []*matrix.DiscreteAxis{baseAxis, compareAxis}}).Compact()
+	if len(unified.Lines) == 0 {
+		return diff
+	}
+	unified.BinaryCompress(*maxDisplayKeys)
+	for _, line := range unified.Lines {
+		line.Reset()
+	}
+	project := func(axis *matrix.DiscreteAxis, count int) []uint64 {
+		dst := unified.Clone()
+		axis.DeProjection(dst)
+		values := make([]uint64, len(dst.Lines))
+		if count == 0 {
+			return values
+		}
+		for i, line := range dst.Lines {
+			values[i] = line.Value.(*SingleUnit).Value / uint64(count)
+		}
+		return values
+	}
+	baseValues := project(baseAxis, baseCount)
+	compareValues := project(compareAxis, compareCount)
+
+	var maxValue uint64
+	for i := range unified.Lines {
+		maxValue = Max(maxValue, Max(baseValues[i], compareValues[i]))
+	}
+	startTime, endTime := base.StartTime, base.EndTime
+	if compare.StartTime.Before(startTime) {
+		startTime = compare.StartTime
+	}
+	if compare.EndTime.After(endTime) {
+		endTime = compare.EndTime
+	}
+	index := tables.labelIndex()
+	keys := unified.GetDiscreteKeys()
+	for i := range unified.Lines {
+		bucket := &DiffBucket{
+			StartKey: keys[i],
+			EndKey:   keys[i+1],
+			Labels:   queryLabels(index, keys[i], keys[i+1], startTime, endTime),
+			Base:     baseValues[i],
+			Compare:  compareValues[i],
+			Diff:     int64(compareValues[i]) - int64(baseValues[i]),
+		}
+		if bucket.Base > 0 {
+			relative := float64(bucket.Diff) / float64(bucket.Base)
+			bucket.Relative = &relative
+		}
+		if math.Abs(float64(bucket.Diff)) >= diffMinShare*float64(maxValue) && bucket.Diff != 0 {
+			switch {
+			case bucket.Compare >= diffRatio*bucket.Base:
+				bucket.Change = diffHotter
+			case bucket.Base >= diffRatio*bucket.Compare:
+				bucket.Change = diffColder
+			}
+		}
+		diff.Buckets = append(diff.Buckets, bucket)
+		if bucket.Change != "" {
+			diff.Highlights = append(diff.Highlights, bucket)
+		}
+	}
+	sort.SliceStable(diff.Highlights, func(i, j int) bool {
+		return math.Abs(float64(diff.Highlights[i].Diff)) > math.Abs(float64(diff.Highlights[j].Diff))
+	})
+	return diff
+}
+
+// diffHandler compares the heatmap of [starttime, endtime] as the base with the one of
+// [compare_starttime, compare_endtime], tag is read_and_written_bytes by default
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	var base, compare TimeWindow
+	var err error
+	base.StartTime, base.EndTime, err = parseTimeRange(r.FormValue("starttime"), r.FormValue("endtime"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("compare_starttime") == "" {
+		http.Error(w, "compare_starttime is required", http.StatusBadRequest)
+		return
+	}
+	compare.StartTime, compare.EndTime, err = parseTimeRange(r.FormValue("compare_starttime"), r.FormValue("compare_endtime"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	startKey, endKey, err := parseKeyRange(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tag := r.FormValue("tag")
+	if tag == "" {
+		tag = "read_and_written_bytes"
+	}
+	if !isHeatmapTag(tag) {
+		http.Error(w, fmt.Sprintf("invalid tag %q", tag), http.StatusBadRequest)
+		return
+	}
+	for _, window := range []TimeWindow{base, compare} {
+		if err := globalRegionStore.CheckRange(window.StartTime, window.EndTime); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	writeJSON(w, GenerateDiff(base, compare, startKey, endKey, tag))
+}
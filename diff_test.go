@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	testdiffpath      = "../test/diff"
+	testdifftablepath = "../test/diff_table"
+)
+
+func TestGenerateDiff(t *testing.T) {
+	globalRegionStore.LeveldbStorage, _ = NewLeveldbStorage(testdiffpath)
+	defer globalRegionStore.LeveldbStorage.Close()
+	openTestTables(testdifftablepath)
+	defer tables.LeveldbStorage.Close()
+	saveTestTables(&Table{Name: "orders", DB: "sales", ID: 45, Indices: map[int64]string{}})
+
+	keys := []string{"", GenTablePrefix(45), GenTablePrefix(46), "~"}
+	start := time.Unix(1574000000, 0)
+	save := func(minutes int, values ...uint64) {
+		at := start.Add(time.Duration(minutes) * time.Minute)
+		axis := &DiscreteAxis{StartKey: keys[0], EndTime: at}
+		for i, value := range values {
+			axis.Lines = append(axis.Lines, &Line{EndKey: keys[i+1], RegionUnit: newRegionUnit(newRegionInfo("", "", value, 0, 0, 0))})
+		}
+		data, err := json.Marshal(axis)
+		perr(err)
+		perr(globalRegionStore.Save(timeKey(at), data))
+	}
+	save(0, 10, 400, 10)
+	save(1, 10, 600, 10)
+	save(10, 10, 10, 1000)
+	save(11, 10, 10, 1000)
+
+	base := TimeWindow{start, start.Add(time.Minute)}
+	compare := TimeWindow{start.Add(10 * time.Minute), start.Add(11 * time.Minute)}
+	diff := GenerateDiff(base, compare, "", "~", "written_bytes")
+	if len(diff.Buckets) != 3 {
+		t.Fatalf("expect 3 buckets, but got %d", len(diff.Buckets))
+	}
+	expect := []struct {
+		base    uint64
+		compare uint64
+		change  string
+	}{
+		{10, 10, ""},
+		{500, 10, diffColder},
+		{10, 1000, diffHotter},
+	}
+	for i, e := range expect {
+		bucket := diff.Buckets[i]
+		if bucket.StartKey != keys[i] || bucket.EndKey != keys[i+1] || bucket.Base != e.base ||
+			bucket.Compare != e.compare || bucket.Diff != int64(e.compare)-int64(e.base) || bucket.Change != e.change {
+			t.Fatalf("bucket %d: expect %v, but got %v", i, e, bucket)
+		}
+	}
+	if *diff.Buckets[2].Relative != 99 {
+		t.Fatalf("expect relative 99, but got %v", *diff.Buckets[2].Relative)
+	}
+	if len(diff.Buckets[1].Labels) != 1 || diff.Buckets[1].Labels[0].Table != "orders" {
+		t.Fatalf("error labels %v", diff.Buckets[1].Labels)
+	}
+	if len(diff.Highlights) != 2 || diff.Highlights[0] != diff.Buckets[2] || diff.Highlights[1] != diff.Buckets[1] {
+		t.Fatalf("error highlights %v", diff.Highlights)
+	}
+
+	recorder := httptest.NewRecorder()
+	diffHandler(recorder, httptest.NewRequest("GET", "/heatmaps/diff?starttime=1574000000&endtime=1574000060", nil))
+	if recorder.Code != 400 {
+		t.Fatalf("expect 400 without the compare window, but got %d", recorder.Code)
+	}
+}
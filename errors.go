@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"runtime/debug"
 )
@@ -14,3 +15,11 @@ func perr(err error) {
 	debug.PrintStack()
 	os.Exit(1)
 }
+
+// lerr logs the error which can be recovered from, without exiting
+func lerr(err error) {
+	if err == nil {
+		return
+	}
+	log.Println(err.Error())
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	formatJSON  = "json"
+	formatCSV   = "csv"
+	formatArrow = "arrow"
+
+	// the amount of rows in a record batch of the arrow stream
+	arrowBatchSize = 4096
+)
+
+// content types of the formats of exported heatmaps
+var exportContentTypes = map[string]string{
+	formatJSON:  "application/json",
+	formatCSV:   "text/csv",
+	formatArrow: "application/vnd.apache.arrow.stream",
+}
+
+// exportRow is a cell of a heatmap in the long form, with one row per metric
+type exportRow struct {
+	TimeStart time.Time
+	TimeEnd   time.Time
+	KeyStart  string
+	KeyEnd    string
+	Label     string
+	Metric    string
+	Value     uint64
+}
+
+var exportColumns = []string{"time_start", "time_end", "key_start", "key_end", "label", "metric", "value"}
+
+// String returns a short description of the label, e.g. "sales.orders/p0 index idx" or "rule user/profile"
+func (l *KeyLabel) String() string {
+	if l.Kind == labelKindRule {
+		return "rule " + l.Rule
+	}
+	s := l.DB + "." + l.Table
+	if l.Partition != "" {
+		s += "/" + l.Partition
+	}
+	if l.Kind == labelKindIndex {
+		s += " index " + l.Index
+	}
+	if l.State != "" {
+		s += " (" + l.State + ")"
+	}
+	return s
+}
+
+// multiMetrics returns the values of a cell which holds all the statistics, named like "max.read_bytes"
+func multiMetrics(unit *MultiUnit) []exportRow {
+	rows := make([]exportRow, 0, 8)
+	for _, mode := range []struct {
+		name  string
+		value *MultiValue
+	}{{"max", &unit.Max}, {"average", &unit.Average}} {
+		rows = append(rows,
+			exportRow{Metric: mode.name + ".read_bytes", Value: mode.value.ReadBytes},
+			exportRow{Metric: mode.name + ".written_bytes", Value: mode.value.WrittenBytes},
+			exportRow{Metric: mode.name + ".read_keys", Value: mode.value.ReadKeys},
+			exportRow{Metric: mode.name + ".written_keys", Value: mode.value.WrittenKeys},
+		)
+	}
+	return rows
+}
+
+// eachExportRow calls emit with the cells of hmap in the long form, ordered by time, key and metric.
+// The metric of a heatmap generated by a tag is the tag itself.
+func eachExportRow(hmap *Heatmap, tag string, emit func(row *exportRow) error) error {
+	if hmap == nil {
+		return nil
+	}
+	labels := make([]string, len(hmap.Keys))
+	for j, label := range hmap.Labels {
+		names := make([]string, 0, len(label.Names))
+		for _, name := range label.Names {
+			names = append(names, name.String())
+		}
+		labels[j] = strings.Join(names, "; ")
+	}
+	for i, axis := range hmap.Data {
+		for j, v := range axis {
+			var rows []exportRow
+			switch value := v.(type) {
+			case uint64:
+				rows = []exportRow{{Metric: tag, Value: value}}
+			case *MultiUnit:
+				rows = multiMetrics(value)
+			}
+			for _, row := range rows {
+				row.TimeStart, row.TimeEnd = hmap.Times[i], hmap.Times[i+1]
+				row.KeyStart, row.KeyEnd = hmap.Keys[j], hmap.Keys[j+1]
+				row.Label = labels[j]
+				if err := emit(&row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// exportCSV writes hmap into w as a csv with a header line
+func exportCSV(w io.Writer, hmap *Heatmap, tag string) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(exportColumns); err != nil {
+		return err
+	}
+	err := eachExportRow(hmap, tag, func(row *exportRow) error {
+		return writer.Write([]string{
+			row.TimeStart.Format(time.RFC3339),
+			row.TimeEnd.Format(time.RFC3339),
+			row.KeyStart,
+			row.KeyEnd,
+			row.Label,
+			row.Metric,
+			strconv.FormatUint(row.Value, 10),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+var arrowSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "time_start", Type: arrow.FixedWidthTypes.Timestamp_s},
+	{Name: "time_end", Type: arrow.FixedWidthTypes.Timestamp_s},
+	{Name: "key_start", Type: arrow.BinaryTypes.String},
+	{Name: "key_end", Type: arrow.BinaryTypes.String},
+	{Name: "label", Type: arrow.BinaryTypes.String},
+	{Name: "metric", Type: arrow.BinaryTypes.String},
+	{Name: "value", Type: arrow.PrimitiveTypes.Uint64},
+}, nil)
+
+// exportArrow writes hmap into w as an arrow IPC stream, in record batches of at most arrowBatchSize rows
+func exportArrow(w io.Writer, hmap *Heatmap, tag string) (err error) {
+	writer := ipc.NewWriter(w, ipc.WithSchema(arrowSchema))
+	defer func() {
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, arrowSchema)
+	defer builder.Release()
+	flush := func() error {
+		record := builder.NewRecord()
+		defer record.Release()
+		if record.NumRows() == 0 {
+			return nil
+		}
+		return writer.Write(record)
+	}
+	err = eachExportRow(hmap, tag, func(row *exportRow) error {
+		builder.Field(0).(*array.TimestampBuilder).Append(arrow.Timestamp(row.TimeStart.Unix()))
+		builder.Field(1).(*array.TimestampBuilder).Append(arrow.Timestamp(row.TimeEnd.Unix()))
+		builder.Field(2).(*array.StringBuilder).Append(row.KeyStart)
+		builder.Field(3).(*array.StringBuilder).Append(row.KeyEnd)
+		builder.Field(4).(*array.StringBuilder).Append(row.Label)
+		builder.Field(5).(*array.StringBuilder).Append(row.Metric)
+		builder.Field(6).(*array.Uint64Builder).Append(row.Value)
+		if builder.Field(0).Len() >= arrowBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// exportHeatmap writes hmap into w in the given format except json
+func exportHeatmap(w io.Writer, hmap *Heatmap, format string, tag string) error {
+	switch format {
+	case formatCSV:
+		return exportCSV(w, hmap, tag)
+	case formatArrow:
+		return exportArrow(w, hmap, tag)
+	}
+	return fmt.Errorf("unsupported format %q", format)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyLabel_String(t *testing.T) {
+	cases := []struct {
+		label  *KeyLabel
+		expect string
+	}{
+		{&KeyLabel{Kind: labelKindData, DB: "sales", Table: "orders"}, "sales.orders"},
+		{&KeyLabel{Kind: labelKindIndex, DB: "sales", Table: "orders", Partition: "p0", Index: "idx"}, "sales.orders/p0 index idx"},
+		{&KeyLabel{Kind: labelKindData, DB: "sales", Table: "orders", State: tableStateDropped}, "sales.orders (dropped)"},
+		{&KeyLabel{Kind: labelKindRule, Rule: "user/profile"}, "rule user/profile"},
+	}
+	for _, c := range cases {
+		if s := c.label.String(); s != c.expect {
+			t.Fatalf("expect %s, but got %s", c.expect, s)
+		}
+	}
+}
+
+func testExportHeatmap(data [][]interface{}) *Heatmap {
+	now := time.Unix(1574000000, 0).UTC()
+	return &Heatmap{
+		Data:  data,
+		Keys:  []string{"", "7480", "~"},
+		Times: []time.Time{now, now.Add(time.Minute), now.Add(2 * time.Minute)},
+		Labels: []*Label{
+			{Names: []*KeyLabel{}},
+			{Names: []*KeyLabel{{Kind: labelKindData, DB: "sales", Table: "orders"}, {Kind: labelKindRule, Rule: "hot"}}},
+		},
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	hmap := testExportHeatmap([][]interface{}{{uint64(1), uint64(2)}, {uint64(3), uint64(4)}})
+	var buf bytes.Buffer
+	perr(exportCSV(&buf, hmap, "read_bytes"))
+	expect := strings.Join([]string{
+		"time_start,time_end,key_start,key_end,label,metric,value",
+		"2019-11-17T14:13:20Z,2019-11-17T14:14:20Z,,7480,,read_bytes,1",
+		"2019-11-17T14:13:20Z,2019-11-17T14:14:20Z,7480,~,sales.orders; rule hot,read_bytes,2",
+		"2019-11-17T14:14:20Z,2019-11-17T14:15:20Z,,7480,,read_bytes,3",
+		"2019-11-17T14:14:20Z,2019-11-17T14:15:20Z,7480,~,sales.orders; rule hot,read_bytes,4",
+	}, "\n") + "\n"
+	if buf.String() != expect {
+		t.Fatalf("expect\n%s\nbut got\n%s", expect, buf.String())
+	}
+
+	// all statistics of a cell
+	unit := &MultiUnit{Max: MultiValue{ReadBytes: 5}}
+	hmap = testExportHeatmap([][]interface{}{{unit, unit}})
+	hmap.Times = hmap.Times[:2]
+	buf.Reset()
+	perr(exportCSV(&buf, hmap, ""))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1+2*8 || !strings.HasSuffix(lines[1], ",max.read_bytes,5") {
+		t.Fatalf("error csv of multi values\n%s", buf.String())
+	}
+
+	// a heatmap without data has the header only
+	buf.Reset()
+	perr(exportCSV(&buf, nil, ""))
+	if buf.String() != strings.Join(exportColumns, ",")+"\n" {
+		t.Fatalf("error csv without data %s", buf.String())
+	}
+}
+
+func TestExportArrow(t *testing.T) {
+	hmap := testExportHeatmap([][]interface{}{{uint64(1), uint64(2)}, {uint64(3), uint64(4)}})
+	var buf bytes.Buffer
+	perr(exportArrow(&buf, hmap, "read_bytes"))
+
+	reader, err := ipc.NewReader(&buf)
+	perr(err)
+	defer reader.Release()
+	if !reader.Schema().Equal(arrowSchema) {
+		t.Fatalf("error schema %v", reader.Schema())
+	}
+	var values []uint64
+	var labels []string
+	for reader.Next() {
+		record := reader.Record()
+		values = append(values, record.Column(6).(*array.Uint64).Uint64Values()...)
+		for i := 0; i < int(record.NumRows()); i++ {
+			labels = append(labels, record.Column(4).(*array.String).Value(i))
+		}
+	}
+	perr(reader.Err())
+	if len(values) != 4 || values[0] != 1 || values[3] != 4 || labels[1] != "sales.orders; rule hot" {
+		t.Fatalf("error records %v %v", values, labels)
+	}
+}
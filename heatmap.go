@@ -1,23 +1,52 @@
 package main
 
 import (
-	"fmt"
 	"github.com/HunDunDM/key-visual/matrix"
 	"sort"
 	"time"
 )
 
+// TagInfo describes a kind of statistics that can be requested by the tag parameter
+type TagInfo struct {
+	Name string `json:"name"`
+	Unit string `json:"unit"`
+}
+
+// ModeInfo describes a way of merging statistics that can be requested by the mode parameter
+type ModeInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// tags supported by GenerateHeatmap, an empty tag returns all the statistics of a cell at once
+var heatmapTags = []*TagInfo{
+	{"read_bytes", "bytes"},
+	{"written_bytes", "bytes"},
+	{"read_keys", "keys"},
+	{"written_keys", "keys"},
+	{"read_and_written_bytes", "bytes"},
+	{"read_and_written_keys", "keys"},
+}
+
+// modes supported by GenerateHeatmap
+var heatmapModes = []*ModeInfo{
+	{"max", "the maximum value among the merged regions"},
+	{"average", "the total value of the merged regions, divided evenly when a region is split"},
+}
+
 type Label struct {
-	StartKey string    `json:"start_key"`
-	EndKey   string    `json:"end_key"`
-	Names    []*string `json:"labels"`
+	StartKey string      `json:"start_key"`
+	EndKey   string      `json:"end_key"`
+	Names    []*KeyLabel `json:"labels"`
 }
 
 type Heatmap struct {
-	Data   [][]interface{} `json:"data"`   // two-dimensional data matrix
-	Keys   []string        `json:"keys"`   // Y-axis of heatmap
-	Times  []time.Time     `json:"times"`  // X-axis of heatmap
-	Labels []*Label        `json:"labels"` // the label information at the left of heatmap indicating tables
+	Data        [][]interface{} `json:"data"`         // two-dimensional data matrix
+	Keys        []string        `json:"keys"`         // Y-axis of heatmap
+	DecodedKeys []string        `json:"decoded_keys"` // human-readable form of Keys, e.g. "t_45_r_100923"
+	Times       []time.Time     `json:"times"`        // X-axis of heatmap
+	Labels      []*Label        `json:"labels"`       // the label information at the left of heatmap indicating tables
+	LabelTree   []*LabelNode    `json:"label_tree"`   // the labels grouped by database, table, partition and data/index
 }
 
 type MultiValue struct {
@@ -146,8 +175,10 @@ func (v *SingleUnit) Equal(other matrix.Value) bool {
 	return *v == *another
 }
 
-func GenerateHeatmap(startTime time.Time, endTime time.Time, startKey string, endKey string, tag, mode string) *Heatmap {
-	separateValue := func(unit *regionUnit) matrix.Value {
+// separateValueFunc returns the function which converts a regionUnit into the value of the tag and the mode,
+// an empty tag means all the statistics
+func separateValueFunc(tag string, mode string) func(unit *regionUnit) matrix.Value {
+	return func(unit *regionUnit) matrix.Value {
 		var m int
 		switch mode {
 		case "average":
@@ -178,6 +209,11 @@ func GenerateHeatmap(startTime time.Time, endTime time.Time, startKey string, en
 		}
 		return single
 	}
+}
+
+// rangePlane returns the axes stored in the time range, with the lines in the key range only
+func rangePlane(startTime time.Time, endTime time.Time, startKey string, endKey string, tag, mode string) *matrix.DiscretePlane {
+	separateValue := separateValueFunc(tag, mode)
 	rangePlane := globalRegionStore.Range(startTime, endTime, separateValue)
 	if rangePlane == nil {
 		return nil
@@ -189,8 +225,15 @@ func GenerateHeatmap(startTime time.Time, endTime time.Time, startKey string, en
 			rangePlane.Axes[i] = tempAxis.Range(startKey, endKey)
 		}
 	}
+	return rangePlane
+}
 
-	newMatrix := rangePlane.Pixel(50, 80)
+func GenerateHeatmap(startTime time.Time, endTime time.Time, startKey string, endKey string, tag, mode string) *Heatmap {
+	rangePlane := rangePlane(startTime, endTime, startKey, endKey, tag, mode)
+	if rangePlane == nil {
+		return nil
+	}
+	newMatrix := rangePlane.Pixel(*maxDisplayTimes, *maxDisplayKeys)
 	heatmap := ChangeIntoHeatmap(newMatrix)
 	return MatchTable(heatmap)
 }
@@ -200,8 +243,12 @@ func ChangeIntoHeatmap(matrix *matrix.Matrix) *Heatmap {
 		return nil
 	}
 	heatmap := &Heatmap{
-		Keys:  matrix.Keys,
-		Times: matrix.Times,
+		Keys:        matrix.Keys,
+		DecodedKeys: make([]string, len(matrix.Keys)),
+		Times:       matrix.Times,
+	}
+	for i, key := range matrix.Keys {
+		heatmap.DecodedKeys[i] = DecodeKey(key, tables.commonHandle)
 	}
 	isMulti := true
 	if _, ok := matrix.Data[0][0].(*SingleUnit); ok {
@@ -232,7 +279,40 @@ func ChangeIntoHeatmap(matrix *matrix.Matrix) *Heatmap {
 	return heatmap
 }
 
-// match tables
+// queryLabels returns the labels of tables in index and label rules which overlap [startKey, endKey),
+// user-defined label rules are applied next to or instead of the schema of TiDB
+func queryLabels(index *LabelIndex, startKey string, endKey string, startTime time.Time, endTime time.Time) []*KeyLabel {
+	labels, replace := labelRules.Query(startKey, endKey)
+	tableLabels := index.Query(startKey, endKey, startTime, endTime)
+	if replace {
+		// the labels of tables are replaced only inside the key ranges of the rules
+		kept := tableLabels[:0]
+		for _, label := range tableLabels {
+			if !coveredBy(labels, maxKey(label.StartKey, startKey), minKey(label.EndKey, endKey)) {
+				kept = append(kept, label)
+			}
+		}
+		tableLabels = kept
+	}
+	return append(tableLabels, labels...)
+}
+
+// coveredBy checks if [startKey, endKey) is covered by the union of the key ranges of labels
+func coveredBy(labels []*KeyLabel, startKey string, endKey string) bool {
+	sorted := append([]*KeyLabel(nil), labels...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].StartKey < sorted[j].StartKey })
+	for _, label := range sorted {
+		if label.StartKey > startKey {
+			break
+		}
+		if label.EndKey > startKey {
+			startKey = label.EndKey
+		}
+	}
+	return startKey >= endKey
+}
+
+// match tables and label rules
 func MatchTable(hmap *Heatmap) *Heatmap {
 	if hmap == nil {
 		return nil
@@ -241,75 +321,30 @@ func MatchTable(hmap *Heatmap) *Heatmap {
 	if keys == nil || len(keys) < 2 {
 		return hmap
 	}
-	hmap.Labels = make([]*Label, 0)
+	// use the schema in effect during the time range of the heatmap
+	endTime := time.Now()
+	startTime := endTime
+	if len(hmap.Times) > 0 {
+		startTime = hmap.Times[0]
+		endTime = hmap.Times[len(hmap.Times)-1]
+	}
+	index := tables.labelIndex()
+	hmap.Labels = make([]*Label, 0, len(keys)-1)
 	for i := 0; i < len(keys)-1; i++ {
-		hmap.Labels = append(hmap.Labels, &Label{
+		label := &Label{
 			StartKey: keys[i],
 			EndKey:   keys[i+1],
-			Names:    make([]*string, 0),
-		})
-	}
-	tables := loadTables()
-	for _, table := range tables {
-		dataStart := GenTableRecordPrefix(table.ID)
-		dataEnd := GenTableRecordPrefix(table.ID + 1)
-
-		start := sort.Search(len(keys), func(i int) bool {
-			return keys[i] > dataStart
-		})
-
-		end := sort.Search(len(keys), func(i int) bool {
-			return keys[i] >= dataEnd
-		})
-		if start > len(keys)-1 {
-			continue
-		}
-		if start > 0 {
-			start--
-		}
-
-		if end >= len(keys) {
-			end = len(keys) - 1
-		}
-		for i := start; i < end; i++ {
-			if dataStart < hmap.Labels[i].StartKey && dataEnd > hmap.Labels[i].EndKey {
-				hmap.Labels[i].StartKey = dataStart
-				hmap.Labels[i].EndKey = dataEnd
-			}
-			name := fmt.Sprintf("tidb:%s, table:%s, data", table.DB, table.Name)
-			hmap.Labels[i].Names = append(hmap.Labels[i].Names, &name)
 		}
-		for idx, idxName := range table.Indices {
-
-			indexStart := GenTableIndexPrefix(table.ID, idx)
-			indexEnd := GenTableIndexPrefix(table.ID, idx+1)
-			start := sort.Search(len(keys), func(i int) bool {
-				return keys[i] > indexStart
-			})
-
-			end := sort.Search(len(keys), func(i int) bool {
-				return keys[i] >= indexEnd
-			})
-
-			if start > len(keys)-1 {
-				continue
-			}
-			if start > 0 {
-				start--
-			}
-			if end >= len(keys) {
-				end = len(keys) - 1
-			}
-
-			for i := start; i < end; i++ {
-				if indexStart < hmap.Labels[i].StartKey && indexEnd > hmap.Labels[i].EndKey {
-					hmap.Labels[i].StartKey = indexStart
-					hmap.Labels[i].EndKey = indexEnd
-				}
-				name := fmt.Sprintf("tidb:%s, table:%s, index:%s", table.DB, table.Name, idxName)
-				hmap.Labels[i].Names = append(hmap.Labels[i].Names, &name)
+		label.Names = queryLabels(index, keys[i], keys[i+1], startTime, endTime)
+		// a row inside a table or an index is labeled with the whole range of it
+		for _, name := range label.Names {
+			if name.StartKey < label.StartKey && name.EndKey > label.EndKey {
+				label.StartKey = name.StartKey
+				label.EndKey = name.EndKey
 			}
 		}
+		hmap.Labels = append(hmap.Labels, label)
 	}
+	hmap.LabelTree = buildLabelTree(hmap.Labels)
 	return hmap
 }
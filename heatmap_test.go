@@ -1,12 +1,11 @@
 package main
 
 import (
-	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"github.com/HunDunDM/key-visual/matrix"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -473,18 +472,15 @@ func SprintfHeatmap(hmap *Heatmap) string {
 }
 
 func TestGenerateHeatmap(t *testing.T) {
-	tables.LeveldbStorage, _ = NewLeveldbStorage("../test/table")
+	openTestTables("../test/table")
 	defer tables.LeveldbStorage.Close()
 	table := Table{
-		"my_sql",
-		"db",
-		5,
-		map[int64]string{},
+		Name:    "my_sql",
+		DB:      "db",
+		ID:      5,
+		Indices: map[int64]string{},
 	}
-	value, _ := json.Marshal(table)
-	var key = make([]byte, 8)
-	binary.BigEndian.PutUint64(key, uint64(table.ID))
-	tables.Save(key, value)
+	saveTestTables(&table)
 
 	globalRegionStore.LeveldbStorage, _ = NewLeveldbStorage("../test/heatmap")
 	defer globalRegionStore.LeveldbStorage.Close()
@@ -625,3 +621,40 @@ func TestGenerateHeatmap(t *testing.T) {
 		t.Fatalf("expect %v, but got %v", expectStr, resultStr)
 	}
 }
+
+const testmatchtablepath = "../test/match_table"
+
+func TestMatchTable(t *testing.T) {
+	openTestTables(testmatchtablepath)
+	defer tables.LeveldbStorage.Close()
+	saveTestTables(&Table{
+		Name:       "orders",
+		DB:         "sales",
+		ID:         45,
+		Indices:    map[int64]string{1: "idx"},
+		Partitions: map[int64]string{46: "p0", 47: "p1"},
+	})
+
+	hmap := &Heatmap{
+		Keys: []string{"", GenTableIndexPrefix(46, 1), GenTableRecordPrefix(46), GenTableRecordPrefix(47), "~"},
+	}
+	MatchTable(hmap)
+	expect := [][]string{
+		{},
+		{"sales.orders/p0 index idx"},
+		{"sales.orders/p0 data", "sales.orders/p1 index idx"},
+		{"sales.orders/p1 data"},
+	}
+	if len(hmap.Labels) != len(expect) {
+		t.Fatalf("expect %d labels, but got %d", len(expect), len(hmap.Labels))
+	}
+	for i, label := range hmap.Labels {
+		names := make([]string, 0, len(label.Names))
+		for _, name := range label.Names {
+			names = append(names, strings.TrimSpace(fmt.Sprintf("%s.%s/%s %s %s", name.DB, name.Table, name.Partition, name.Kind, name.Index)))
+		}
+		if !reflect.DeepEqual(names, expect[i]) {
+			t.Fatalf("label %d: expect %v, but got %v", i, expect[i], names)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// the default and the maximum amount of axes in a page of region history
+	defaultHistoryLimit = 60
+	maxHistoryLimit     = 1000
+)
+
+// HistoryLine is a line of a stored axis, which covers [StartKey, EndKey)
+type HistoryLine struct {
+	StartKey   string      `json:"start_key"`
+	EndKey     string      `json:"end_key"`
+	RegionUnit *regionUnit `json:"region_unit"`
+}
+
+// HistoryAxis is a stored axis with the lines overlapping the requested key range
+type HistoryAxis struct {
+	EndTime time.Time      `json:"end_time"`
+	Lines   []*HistoryLine `json:"lines"`
+}
+
+// timeKey is the storage key of the axis stored at t
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.Unix()))
+	return key
+}
+
+// History calls fn with the axes stored in [startTime, endTime] in time order, until fn returns false.
+// at is the time when the axis is stored, and only lines overlapping [startKey, endKey) are kept.
+func (r *RegionStore) History(startTime time.Time, endTime time.Time, startKey string, endKey string,
+	fn func(at time.Time, axis *HistoryAxis) bool) error {
+	return r.Scan(timeKey(startTime), timeKey(endTime.Add(time.Second)), func(key, value []byte) bool {
+		var axis DiscreteAxis
+		err := json.Unmarshal(value, &axis)
+		perr(err)
+		historyAxis := &HistoryAxis{EndTime: axis.EndTime, Lines: make([]*HistoryLine, 0)}
+		lineStart := axis.StartKey
+		for _, line := range axis.Lines {
+			if line.EndKey > startKey && lineStart < endKey {
+				historyAxis.Lines = append(historyAxis.Lines, &HistoryLine{
+					StartKey:   lineStart,
+					EndKey:     line.EndKey,
+					RegionUnit: line.RegionUnit,
+				})
+			}
+			lineStart = line.EndKey
+		}
+		return fn(time.Unix(int64(binary.BigEndian.Uint64(key)), 0), historyAxis)
+	})
+}
+
+// regionHistoryHandler returns the axes stored in the time range as recorded, without pixelation.
+// At most limit axes are returned, and next_starttime is the starttime of the next page if there are more axes.
+// The axes are streamed one by one.
+func regionHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	startTime, endTime, err := parseTimeRange(r.FormValue("starttime"), r.FormValue("endtime"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	startKey, endKey, err := parseKeyRange(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultHistoryLimit
+	if s := r.FormValue("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > maxHistoryLimit {
+			http.Error(w, fmt.Sprintf("invalid limit %q, expect an integer in [1, %d]", s, maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	var next *int64
+	write := func(data []byte) bool {
+		_, err := w.Write(data)
+		return err == nil
+	}
+	if !write([]byte(`{"axes":[`)) {
+		return
+	}
+	err = globalRegionStore.History(startTime, endTime, startKey, endKey, func(at time.Time, axis *HistoryAxis) bool {
+		if count == limit {
+			nextTime := at.Unix()
+			next = &nextTime
+			return false
+		}
+		data, err := json.Marshal(axis)
+		perr(err)
+		if count > 0 {
+			data = append([]byte(","), data...)
+		}
+		count++
+		if !write(data) {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	})
+	// the response has begun, so that an error can only be logged
+	lerr(err)
+	tail, err := json.Marshal(next)
+	perr(err)
+	write(append(append([]byte(`],"next_starttime":`), tail...), '}'))
+}
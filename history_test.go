@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testhistorypath = "../test/history"
+
+func TestRegionHistoryHandler(t *testing.T) {
+	globalRegionStore.LeveldbStorage, _ = NewLeveldbStorage(testhistorypath)
+	defer globalRegionStore.LeveldbStorage.Close()
+	start := time.Unix(1574000000, 0)
+	for i := 0; i < 3; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		axis := &DiscreteAxis{
+			StartKey: "",
+			EndTime:  at,
+			Lines: []*Line{
+				{EndKey: "a", RegionUnit: newRegionUnit(newRegionInfo("", "a", 1, 0, 0, 0))},
+				{EndKey: "c", RegionUnit: newRegionUnit(newRegionInfo("a", "c", uint64(i), 0, 0, 0))},
+				{EndKey: "~", RegionUnit: newRegionUnit(newRegionInfo("c", "~", 3, 0, 0, 0))},
+			},
+		}
+		value, err := json.Marshal(axis)
+		perr(err)
+		perr(globalRegionStore.Save(timeKey(at), value))
+	}
+
+	var page struct {
+		Axes          []*HistoryAxis `json:"axes"`
+		NextStartTime *int64         `json:"next_starttime"`
+	}
+	request := func(query string) {
+		recorder := httptest.NewRecorder()
+		regionHistoryHandler(recorder, httptest.NewRequest("GET", "/api/v1/regions/history?"+query, nil))
+		if recorder.Code != 200 {
+			t.Fatalf("expect 200, but got %d, %s", recorder.Code, recorder.Body.String())
+		}
+		page.Axes, page.NextStartTime = nil, nil
+		perr(json.Unmarshal(recorder.Body.Bytes(), &page))
+	}
+
+	request("starttime=1574000000&endtime=1574000300&startkey=b&endkey=c&limit=2")
+	if len(page.Axes) != 2 || page.NextStartTime == nil || *page.NextStartTime != 1574000120 {
+		t.Fatalf("error page %v, next %v", page.Axes, page.NextStartTime)
+	}
+	for i, axis := range page.Axes {
+		if len(axis.Lines) != 1 || axis.Lines[0].StartKey != "a" || axis.Lines[0].EndKey != "c" ||
+			axis.Lines[0].RegionUnit.Max.WrittenBytes != uint64(i) {
+			t.Fatalf("error lines of axis %d", i)
+		}
+	}
+
+	request("starttime=1574000120&endtime=1574000300&limit=2")
+	if len(page.Axes) != 1 || page.NextStartTime != nil || len(page.Axes[0].Lines) != 3 {
+		t.Fatalf("error last page %v, next %v", page.Axes, page.NextStartTime)
+	}
+
+	recorder := httptest.NewRecorder()
+	regionHistoryHandler(recorder, httptest.NewRequest("GET", "/api/v1/regions/history?limit=0", nil))
+	if recorder.Code != 400 {
+		t.Fatalf("expect 400, but got %d", recorder.Code)
+	}
+}
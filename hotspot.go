@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/pingcap/goleveldb/leveldb"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hotspotWriteTail = "write_tail" // written at the tail of the records of a table, e.g. sequential inserts
+	hotspotHotRow    = "hot_row"    // written at a few rows of a table
+	hotspotHotIndex  = "hot_index"  // written at an index
+	hotspotWrite     = "write"      // written at a key range out of tables
+	hotspotRead      = "read"
+	hotspotMoving    = "moving" // a hot range which moves over time
+
+	severityWarning  = "warning"
+	severityCritical = "critical"
+
+	// the smoothing factor of the history of a key range
+	hotspotBaselineAlpha = 0.2
+	// the score from which a hotspot is critical, in times of *hotspotRatio
+	criticalScoreTimes = 4
+)
+
+// HotspotEvent is a hotspot detected during [Since, LastSeen]
+type HotspotEvent struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Metric   string    `json:"metric"` // "written_bytes" or "read_bytes"
+	StartKey string    `json:"start_key"`
+	EndKey   string    `json:"end_key"`
+	Label    string    `json:"label"`
+	Severity string    `json:"severity"`
+	Score    float64   `json:"score"` // the peak of how many times the value is of its neighbours or its history
+	Value    uint64    `json:"value"` // the peak value
+	Since    time.Time `json:"since"`
+	LastSeen time.Time `json:"last_seen"`
+	Duration int64     `json:"duration"` // seconds from Since to LastSeen
+
+	key []byte // the storage key
+}
+
+// storageKey is the start time of the event followed by a sequence number
+func (e *HotspotEvent) storageKey(seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(e.Since.Unix()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// HotspotDetector detects hotspots in each stored axis and saves them as events
+type HotspotDetector struct {
+	sync.Mutex
+	*LeveldbStorage
+	// the events which may continue in the next axis
+	ongoing []*HotspotEvent
+	seq     uint64
+	// the smoothed history of the lines of the last axis by metric
+	baseline map[string][]historyRange
+	// the longest duration of the stored events, which bounds how early an event seen in a time range can start
+	maxDuration time.Duration
+}
+
+// open replaces the storage of the detector, and finds the longest duration of the stored events
+func (d *HotspotDetector) open(storage *LeveldbStorage) error {
+	d.Lock()
+	defer d.Unlock()
+	d.LeveldbStorage = storage
+	d.maxDuration = 0
+	return d.Scan(nil, nil, func(key, value []byte) bool {
+		var event HotspotEvent
+		if err := json.Unmarshal(value, &event); err == nil && event.LastSeen.Sub(event.Since) > d.maxDuration {
+			d.maxDuration = event.LastSeen.Sub(event.Since)
+		}
+		return true
+	})
+}
+
+// hotLine is a line which is much hotter than its neighbours or its history
+type hotLine struct {
+	metric   string
+	startKey string
+	endKey   string
+	value    uint64
+	score    float64
+	labels   []*KeyLabel
+}
+
+// historyRange is the smoothed history of a line
+type historyRange struct {
+	startKey string
+	endKey   string
+	value    float64
+}
+
+// interpolateHistory returns the history of [startKey, endKey) as the sum of the parts of the sorted ranges it overlaps,
+// so that the history is kept when regions split or merge. It returns false if no range overlaps.
+func interpolateHistory(ranges []historyRange, startKey string, endKey string) (float64, bool) {
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].endKey > startKey })
+	history, found := 0.0, false
+	for ; i < len(ranges) && ranges[i].startKey < endKey; i++ {
+		r := ranges[i]
+		ratio := keyPosition(minKey(r.endKey, endKey), r.startKey, r.endKey) - keyPosition(maxKey(r.startKey, startKey), r.startKey, r.endKey)
+		history += r.value * ratio
+		found = true
+	}
+	return history, found
+}
+
+// hotspotMetrics are the metrics checked by the detector
+var hotspotMetrics = []struct {
+	name  string
+	value func(unit *regionUnit) uint64
+}{
+	{"written_bytes", func(unit *regionUnit) uint64 { return unit.Max.WrittenBytes }},
+	{"read_bytes", func(unit *regionUnit) uint64 { return unit.Max.ReadBytes }},
+}
+
+// findHotLines compares each line of axis with the lines next to it and with its history.
+// A line is hot if its value is at least *hotspotThreshold, and at least *hotspotRatio times of
+// one of its neighbours or of its history. The baseline of history is updated.
+func (d *HotspotDetector) findHotLines(axis *DiscreteAxis) []*hotLine {
+	baseline := make(map[string][]historyRange, len(hotspotMetrics))
+	hotLines := make([]*hotLine, 0)
+	for _, metric := range hotspotMetrics {
+		values := make([]float64, len(axis.Lines))
+		for i, line := range axis.Lines {
+			values[i] = float64(metric.value(line.RegionUnit))
+		}
+		ranges := make([]historyRange, 0, len(axis.Lines))
+		lineStart := axis.StartKey
+		for i, line := range axis.Lines {
+			startKey := lineStart
+			lineStart = line.EndKey
+			history, hasHistory := interpolateHistory(d.baseline[metric.name], startKey, line.EndKey)
+			smoothed := values[i]
+			if hasHistory {
+				smoothed = history*(1-hotspotBaselineAlpha) + values[i]*hotspotBaselineAlpha
+			}
+			ranges = append(ranges, historyRange{startKey, line.EndKey, smoothed})
+			if values[i] < float64(*hotspotThreshold) {
+				continue
+			}
+			// a hot range may consist of several lines, so it is compared with the cooler neighbour
+			neighbour := -1.0
+			for _, j := range []int{i - 1, i + 1} {
+				if j >= 0 && j < len(values) && (neighbour < 0 || values[j] < neighbour) {
+					neighbour = values[j]
+				}
+			}
+			score := 0.0
+			if neighbour >= 0 {
+				score = values[i] / maxFloat(neighbour, 1)
+			}
+			if hasHistory {
+				score = maxFloat(score, values[i]/maxFloat(history, 1))
+			}
+			if score < *hotspotRatio {
+				continue
+			}
+			hotLines = append(hotLines, &hotLine{
+				metric:   metric.name,
+				startKey: startKey,
+				endKey:   line.EndKey,
+				value:    uint64(values[i]),
+				score:    score,
+			})
+		}
+		baseline[metric.name] = ranges
+	}
+	d.baseline = baseline
+	return hotLines
+}
+
+func maxFloat(a float64, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// classify returns the kind of a hot line by the labels it overlaps
+func (l *hotLine) classify() string {
+	if l.metric == "read_bytes" {
+		return hotspotRead
+	}
+	kind := hotspotWrite
+	for _, label := range l.labels {
+		switch label.Kind {
+		case labelKindData:
+			// the line reaches the end of the records, where new rows with increasing handles are inserted
+			if l.endKey >= label.EndKey {
+				return hotspotWriteTail
+			}
+			kind = hotspotHotRow
+		case labelKindIndex:
+			if kind == hotspotWrite {
+				kind = hotspotHotIndex
+			}
+		}
+	}
+	return kind
+}
+
+func overlap(startKey1 string, endKey1 string, startKey2 string, endKey2 string) bool {
+	return startKey1 < endKey2 && startKey2 < endKey1
+}
+
+// match finds the ongoing event which the hot line of the axis at the time at continues.
+// An event continues if the hot line overlaps it or is next to it in the same axis, or if it moves within the same label.
+func (d *HotspotDetector) match(line *hotLine, kind string, label string, at time.Time) (event *HotspotEvent, moved bool) {
+	for _, e := range d.ongoing {
+		if e.Metric != line.metric {
+			continue
+		}
+		adjacent := e.LastSeen.Equal(at) && (e.EndKey == line.startKey || line.endKey == e.StartKey)
+		if adjacent || overlap(e.StartKey, e.EndKey, line.startKey, line.endKey) {
+			return e, false
+		}
+	}
+	// the tail of a table moves when the region at the tail splits, which is not regarded as a moving hotspot
+	if label == "" || kind == hotspotWriteTail {
+		return nil, false
+	}
+	for _, e := range d.ongoing {
+		if e.Metric == line.metric && e.Label == label && e.Kind != hotspotWriteTail && !e.LastSeen.Equal(at) {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Detect finds hotspots in an axis stored at the time at, and saves them as new or continued events
+func (d *HotspotDetector) Detect(axis *DiscreteAxis, at time.Time) {
+	if axis == nil {
+		return
+	}
+	index := tables.labelIndex()
+	d.Lock()
+	defer d.Unlock()
+	// an event ends if it is not seen in the last two intervals
+	ongoing := d.ongoing[:0]
+	for _, e := range d.ongoing {
+		if at.Sub(e.LastSeen) <= 2*(*interval) {
+			ongoing = append(ongoing, e)
+		}
+	}
+	d.ongoing = ongoing
+
+	for _, line := range d.findHotLines(axis) {
+		line.labels = queryLabels(index, line.startKey, line.endKey, at, at)
+		names := make([]string, 0, len(line.labels))
+		for _, label := range line.labels {
+			names = append(names, label.String())
+		}
+		label := strings.Join(names, "; ")
+		kind := line.classify()
+		event, moved := d.match(line, kind, label, at)
+		if event == nil {
+			event = &HotspotEvent{Metric: line.metric, Since: at}
+			d.seq++
+			event.key = event.storageKey(d.seq)
+			event.ID = fmt.Sprintf("%x", event.key)
+			d.ongoing = append(d.ongoing, event)
+		} else if moved || event.Kind == hotspotMoving {
+			kind = hotspotMoving
+		}
+		if event.LastSeen.Equal(at) {
+			// adjacent hot lines of the same axis belong to the same event
+			if line.startKey < event.StartKey {
+				event.StartKey = line.startKey
+			}
+			if line.endKey > event.EndKey {
+				event.EndKey = line.endKey
+			}
+		} else {
+			event.Kind = kind
+			event.StartKey, event.EndKey, event.Label = line.startKey, line.endKey, label
+		}
+		if line.score > event.Score {
+			event.Score = line.score
+		}
+		if line.value > event.Value {
+			event.Value = line.value
+		}
+		event.Severity = severityWarning
+		if event.Score >= criticalScoreTimes*(*hotspotRatio) {
+			event.Severity = severityCritical
+		}
+		event.LastSeen = at
+		event.Duration = int64(event.LastSeen.Sub(event.Since) / time.Second)
+		if duration := event.LastSeen.Sub(event.Since); duration > d.maxDuration {
+			d.maxDuration = duration
+		}
+		value, err := json.Marshal(event)
+		if err != nil {
+			lerr(err)
+			continue
+		}
+		lerr(d.Save(event.key, value))
+	}
+}
+
+// Events returns the events which are seen during [startTime, endTime], filtered by kind if it is not empty
+func (d *HotspotDetector) Events(startTime time.Time, endTime time.Time, kind string) ([]*HotspotEvent, error) {
+	d.Lock()
+	earliest := startTime.Add(-d.maxDuration)
+	d.Unlock()
+	events := make([]*HotspotEvent, 0)
+	err := d.Scan(timeKey(earliest), timeKey(endTime.Add(time.Second)), func(key, value []byte) bool {
+		var event HotspotEvent
+		err := json.Unmarshal(value, &event)
+		perr(err)
+		if !event.LastSeen.Before(startTime) && (kind == "" || event.Kind == kind) {
+			events = append(events, &event)
+		}
+		return true
+	})
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Since.Before(events[j].Since) })
+	return events, err
+}
+
+// DeleteBefore deletes the events which are last seen before t, and returns the amount of deleted events
+func (d *HotspotDetector) DeleteBefore(t time.Time) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	batch := new(leveldb.Batch)
+	// an event last seen before t starts before t
+	err := d.Scan(nil, timeKey(t), func(key, value []byte) bool {
+		var event HotspotEvent
+		if err := json.Unmarshal(value, &event); err == nil && event.LastSeen.Before(t) {
+			batch.Delete(append([]byte(nil), key...))
+		}
+		return true
+	})
+	if err != nil || batch.Len() == 0 {
+		return 0, err
+	}
+	if err := d.Write(batch, nil); err != nil {
+		return 0, err
+	}
+	return batch.Len(), nil
+}
+
+// hotspotsHandler returns the hotspots detected in the time range, which can be filtered by kind
+func hotspotsHandler(w http.ResponseWriter, r *http.Request) {
+	startTime, endTime, err := parseTimeRange(r.FormValue("starttime"), r.FormValue("endtime"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events, err := hotspots.Events(startTime, endTime, r.FormValue("kind"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, events)
+}
+
+var hotspots HotspotDetector
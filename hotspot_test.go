@@ -0,0 +1,137 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+const (
+	testhotspotpath      = "../test/hotspot"
+	testhotspottablepath = "../test/hotspot_table"
+)
+
+func TestHotspotDetector_Detect(t *testing.T) {
+	openTestTables(testhotspottablepath)
+	defer tables.LeveldbStorage.Close()
+	saveTestTables(&Table{Name: "orders", DB: "sales", ID: 45, Indices: map[int64]string{1: "idx"}})
+	var detector HotspotDetector
+	storage, err := NewLeveldbStorage(testhotspotpath)
+	perr(err)
+	perr(detector.open(storage))
+	defer detector.LeveldbStorage.Close()
+
+	keys := []string{
+		"",
+		GenTableIndexPrefix(45, 1),
+		GenTableRecordPrefix(45),
+		GenTableRowKey(45, 1000),
+		GenTableRowKey(45, 2000),
+		GenTablePrefix(46),
+		"~",
+	}
+	// each line is written 4KB, except the hot ones
+	newAxis := func(at time.Time, hot map[int]uint64, read bool) *DiscreteAxis {
+		axis := &DiscreteAxis{StartKey: keys[0], EndTime: at}
+		for i := 1; i < len(keys); i++ {
+			value := uint64(4 << 10)
+			if v, ok := hot[i-1]; ok {
+				value = v
+			}
+			info := newRegionInfo(keys[i-1], keys[i], value, 0, 0, 0)
+			if read {
+				info.WrittenBytes, info.ReadBytes = 0, value
+			}
+			axis.Lines = append(axis.Lines, &Line{EndKey: keys[i], RegionUnit: newRegionUnit(info)})
+		}
+		return axis
+	}
+	start := time.Unix(1574000000, 0)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	hot := uint64(64 << 20)
+
+	// lines are indexed from 0, and events end after two intervals without hotspots
+	detector.Detect(newAxis(at(0), map[int]uint64{4: hot}, false), at(0))
+	detector.Detect(newAxis(at(1), map[int]uint64{4: hot}, false), at(1))
+	detector.Detect(newAxis(at(10), map[int]uint64{1: hot}, false), at(10))
+	detector.Detect(newAxis(at(20), map[int]uint64{2: hot}, false), at(20))
+	detector.Detect(newAxis(at(21), map[int]uint64{3: hot}, false), at(21))
+	detector.Detect(newAxis(at(30), map[int]uint64{2: hot, 3: hot}, false), at(30))
+	detector.Detect(newAxis(at(40), map[int]uint64{5: hot}, true), at(40))
+	// not hot enough
+	detector.Detect(newAxis(at(50), map[int]uint64{5: 8 << 10}, false), at(50))
+
+	events, err := detector.Events(start, at(60), "")
+	perr(err)
+	expect := []struct {
+		kind     string
+		startKey string
+		endKey   string
+		label    string
+		duration int64
+	}{
+		{hotspotWriteTail, keys[4], keys[5], "sales.orders", 60},
+		{hotspotHotIndex, keys[1], keys[2], "sales.orders index idx", 0},
+		{hotspotMoving, keys[3], keys[4], "sales.orders", 60},
+		{hotspotHotRow, keys[2], keys[4], "sales.orders", 0},
+		{hotspotRead, keys[5], keys[6], "", 0},
+	}
+	if len(events) != len(expect) {
+		t.Fatalf("expect %d events, but got %d", len(expect), len(events))
+	}
+	for i, e := range expect {
+		event := events[i]
+		if event.Kind != e.kind || event.StartKey != e.startKey || event.EndKey != e.endKey ||
+			event.Label != e.label || event.Duration != e.duration || event.Severity != severityCritical {
+			t.Fatalf("event %d: expect %v, but got %v", i, e, event)
+		}
+	}
+
+	events, err = detector.Events(at(15), at(25), hotspotMoving)
+	perr(err)
+	if len(events) != 1 {
+		t.Fatalf("expect 1 moving event, but got %d", len(events))
+	}
+	// an event started before the time range is found by the longest duration
+	events, err = detector.Events(at(1), at(5), "")
+	perr(err)
+	if len(events) != 1 || events[0].Kind != hotspotWriteTail {
+		t.Fatalf("expect the write tail event, but got %v", events)
+	}
+
+	// the events last seen before the retention are deleted
+	n, err := detector.DeleteBefore(at(15))
+	perr(err)
+	if events, _ = detector.Events(start, at(60), ""); n != 2 || len(events) != 3 {
+		t.Fatalf("expect 2 events deleted and 3 left, but got %d and %d", n, len(events))
+	}
+}
+
+func TestHotspotDetector_findHotLines(t *testing.T) {
+	newAxis := func(keys []string, value uint64) *DiscreteAxis {
+		axis := &DiscreteAxis{StartKey: keys[0]}
+		for i := 1; i < len(keys); i++ {
+			info := newRegionInfo(keys[i-1], keys[i], value, 0, 0, 0)
+			axis.Lines = append(axis.Lines, &Line{EndKey: keys[i], RegionUnit: newRegionUnit(info)})
+		}
+		return axis
+	}
+	var detector HotspotDetector
+	if lines := detector.findHotLines(newAxis([]string{"", "80", "~"}, 20<<20)); len(lines) != 0 {
+		t.Fatalf("expect no hot lines, but got %v", lines)
+	}
+	// the first region splits into two, whose history is half of it, and all the lines are as hot as their neighbours
+	lines := detector.findHotLines(newAxis([]string{"", "40", "80", "~"}, 200<<20))
+	if len(lines) != 3 {
+		t.Fatalf("expect 3 hot lines, but got %d", len(lines))
+	}
+	for i, score := range []float64{20, 20, 10} {
+		if math.Abs(lines[i].score-score) > 1e-9 {
+			t.Fatalf("line %d: expect score %v, but got %v", i, score, lines[i].score)
+		}
+	}
+	// the regions merge, whose history is the sum of the smoothed history of them, 48MB, 48MB and 56MB
+	if history, _ := interpolateHistory(detector.baseline["written_bytes"], "", "~"); math.Abs(history-152<<20) > 1 {
+		t.Fatalf("error history %v", history)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	labelKindData  = "data"
+	labelKindIndex = "index"
+	labelKindRule  = "rule"
+)
+
+// KeyLabel describes what a key range belongs to
+type KeyLabel struct {
+	Kind      string `json:"kind"` // "data" or "index" of a TiDB table, or "rule" of a user-defined label rule
+	DB        string `json:"db,omitempty"`
+	Table     string `json:"table,omitempty"`
+	Partition string `json:"partition,omitempty"`
+	Index     string `json:"index,omitempty"`
+	State     string `json:"state,omitempty"` // "dropped" or "truncated" if the table has ended
+	Rule      string `json:"rule,omitempty"`  // the path of a label rule, e.g. "user/profile"
+	StartKey  string `json:"start_key"`
+	EndKey    string `json:"end_key"`
+}
+
+// an entry of LabelIndex
+type labelInterval struct {
+	label *KeyLabel
+	// the version of the table which the label belongs to, nil if the label does not belong to a table
+	table *Table
+}
+
+// LabelIndex is an interval index of labeled key ranges.
+// Intervals are sorted by their start keys, and maxEnd[i] is the biggest end key among intervals[0..i],
+// so that a query only visits the intervals before its end key, until no earlier interval can reach its start key.
+type LabelIndex struct {
+	intervals []*labelInterval
+	maxEnd    []string
+}
+
+func newLabelIndex(intervals []*labelInterval) *LabelIndex {
+	index := &LabelIndex{intervals: intervals}
+	sort.Slice(index.intervals, func(i, j int) bool {
+		return index.intervals[i].label.StartKey < index.intervals[j].label.StartKey
+	})
+	index.maxEnd = make([]string, len(index.intervals))
+	for i, interval := range index.intervals {
+		index.maxEnd[i] = interval.label.EndKey
+		if i > 0 && index.maxEnd[i-1] > index.maxEnd[i] {
+			index.maxEnd[i] = index.maxEnd[i-1]
+		}
+	}
+	return index
+}
+
+// buildTableIndex builds the index of the data and indices of all versions of tables
+func buildTableIndex(versions []*Table) *LabelIndex {
+	intervals := make([]*labelInterval, 0)
+	for _, table := range versions {
+		for _, physical := range table.physicalTables() {
+			intervals = append(intervals, &labelInterval{
+				label: &KeyLabel{
+					Kind:      labelKindData,
+					DB:        table.DB,
+					Table:     table.Name,
+					Partition: physical.Partition,
+					StartKey:  GenTableRecordPrefix(physical.ID),
+					EndKey:    GenTablePrefix(physical.ID + 1),
+				},
+				table: table,
+			})
+			for idx, idxName := range table.Indices {
+				intervals = append(intervals, &labelInterval{
+					label: &KeyLabel{
+						Kind:      labelKindIndex,
+						DB:        table.DB,
+						Table:     table.Name,
+						Partition: physical.Partition,
+						Index:     idxName,
+						StartKey:  GenTableIndexPrefix(physical.ID, idx),
+						EndKey:    GenTableIndexPrefix(physical.ID, idx+1),
+					},
+					table: table,
+				})
+			}
+		}
+	}
+	return newLabelIndex(intervals)
+}
+
+// Query returns the labels of key ranges which overlap [startKey, endKey), sorted by their start keys.
+// Labels of tables are returned only if the tables are in effect during [startTime, endTime],
+// and for a table which has several versions in the time range, the latest one is used.
+func (index *LabelIndex) Query(startKey string, endKey string, startTime time.Time, endTime time.Time) []*KeyLabel {
+	hi := sort.Search(len(index.intervals), func(i int) bool {
+		return index.intervals[i].label.StartKey >= endKey
+	})
+	hits := make([]*labelInterval, 0)
+	latest := make(map[int64]time.Time)
+	for i := hi - 1; i >= 0 && index.maxEnd[i] > startKey; i-- {
+		interval := index.intervals[i]
+		if interval.label.EndKey <= startKey {
+			continue
+		}
+		if table := interval.table; table != nil {
+			if !table.inEffect(startTime, endTime) {
+				continue
+			}
+			if since, ok := latest[table.ID]; !ok || since.Before(table.Since) {
+				latest[table.ID] = table.Since
+			}
+		}
+		hits = append(hits, interval)
+	}
+	labels := make([]*KeyLabel, 0, len(hits))
+	// hits are visited backwards
+	for i := len(hits) - 1; i >= 0; i-- {
+		label := *hits[i].label
+		if table := hits[i].table; table != nil {
+			if !table.Since.Equal(latest[table.ID]) {
+				continue
+			}
+			if table.endedAt(endTime) {
+				label.State = table.State
+			}
+		}
+		labels = append(labels, &label)
+	}
+	return labels
+}
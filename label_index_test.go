@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLabelIndex_Query(t *testing.T) {
+	t0 := time.Unix(1571900000, 0)
+	t1 := t0.Add(time.Hour)
+	index := buildTableIndex([]*Table{
+		{Name: "orders", DB: "sales", ID: 45, Indices: map[int64]string{1: "idx"}, Until: t1},
+		{Name: "orders_v2", DB: "sales", ID: 45, Indices: map[int64]string{1: "idx"}, Since: t1},
+		{Name: "users", DB: "sales", ID: 46, Until: t1, State: tableStateDropped},
+		{Name: "logs", DB: "sales", ID: 50, Since: t1},
+	})
+	names := func(labels []*KeyLabel) []string {
+		result := make([]string, 0, len(labels))
+		for _, label := range labels {
+			name := label.Table + " " + label.Kind
+			if label.State != "" {
+				name += " " + label.State
+			}
+			result = append(result, name)
+		}
+		return result
+	}
+	cases := []struct {
+		startKey  string
+		endKey    string
+		startTime time.Time
+		endTime   time.Time
+		expect    []string
+	}{
+		{"", "~", t0, t0, []string{"orders index", "orders data", "users data"}},
+		{"", "~", t0, t1.Add(time.Minute), []string{"orders_v2 index", "orders_v2 data", "users data dropped", "logs data"}},
+		{GenTableRecordPrefix(45), GenTableRecordPrefix(46), t0, t0, []string{"orders data"}},
+		{GenTableRowKey(45, 1), GenTableRowKey(45, 2), t0, t0, []string{"orders data"}},
+		{GenTablePrefix(46), GenTablePrefix(47), t0, t0, []string{"users data"}},
+		{GenTablePrefix(47), GenTablePrefix(50), t0, t1, []string{}},
+		{"", GenTablePrefix(45), t0, t1, []string{}},
+	}
+	for i, c := range cases {
+		result := names(index.Query(c.startKey, c.endKey, c.startTime, c.endTime))
+		if !reflect.DeepEqual(result, c.expect) {
+			t.Fatalf("case %d: expect %v, but got %v", i, c.expect, result)
+		}
+	}
+}
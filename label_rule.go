@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// labels of rules are appended to the labels of TiDB tables
+	labelRuleModeAppend = "append"
+	// labels of rules replace the labels of TiDB tables inside the key ranges of the rules
+	labelRuleModeReplace = "replace"
+)
+
+// LabelRule labels a key range with its name, which is given by one of
+// a raw key prefix, a hex key prefix, or a hex key range [StartKey, EndKey) where an empty EndKey means no limit.
+// Children label sub ranges of the range, and their labels are named by the path from the root, e.g. "user/profile".
+type LabelRule struct {
+	Name      string       `json:"name" yaml:"name"`
+	Prefix    string       `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	HexPrefix string       `json:"hex_prefix,omitempty" yaml:"hex_prefix,omitempty"`
+	StartKey  string       `json:"start_key,omitempty" yaml:"start_key,omitempty"`
+	EndKey    string       `json:"end_key,omitempty" yaml:"end_key,omitempty"`
+	Children  []*LabelRule `json:"children,omitempty" yaml:"children,omitempty"`
+}
+
+// LabelRuleSet is the content of a label rule file
+type LabelRuleSet struct {
+	Mode string `json:"mode" yaml:"mode"` // "append" or "replace", default to "append"
+	// whether keys are encoded in the memcomparable format as TiDB and TxnKV do,
+	// it should be false for RawKV, whose region keys are the raw keys
+	Encoded bool         `json:"encoded" yaml:"encoded"`
+	Rules   []*LabelRule `json:"rules" yaml:"rules"`
+}
+
+// prefixNext returns the smallest key which is bigger than all keys with the prefix, nil if there is no such key
+func prefixNext(prefix []byte) []byte {
+	next := append([]byte(nil), prefix...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next[:i+1]
+		}
+	}
+	return nil
+}
+
+// regionKey converts a raw key into the form of region keys, nil means the end of the key space
+func (set *LabelRuleSet) regionKey(raw []byte) string {
+	if raw == nil {
+		return "~"
+	}
+	if set.Encoded {
+		raw = EncodeBytes(raw)
+	}
+	return strings.ToUpper(hex.EncodeToString(raw))
+}
+
+// keyRange returns the range of the rule in the form of region keys
+func (set *LabelRuleSet) keyRange(rule *LabelRule) (startKey string, endKey string, err error) {
+	var start, end []byte
+	switch {
+	case rule.Prefix != "" && rule.HexPrefix == "" && rule.StartKey == "" && rule.EndKey == "":
+		start = []byte(rule.Prefix)
+		end = prefixNext(start)
+	case rule.HexPrefix != "" && rule.Prefix == "" && rule.StartKey == "" && rule.EndKey == "":
+		if start, err = hex.DecodeString(rule.HexPrefix); err != nil {
+			return "", "", fmt.Errorf("rule %s: invalid hex_prefix %q", rule.Name, rule.HexPrefix)
+		}
+		end = prefixNext(start)
+	case rule.Prefix == "" && rule.HexPrefix == "" && rule.StartKey == "" && rule.EndKey == "":
+		return "", "", fmt.Errorf("rule %s: no key range is given", rule.Name)
+	case rule.Prefix == "" && rule.HexPrefix == "":
+		if start, err = hex.DecodeString(rule.StartKey); err != nil {
+			return "", "", fmt.Errorf("rule %s: invalid start_key %q", rule.Name, rule.StartKey)
+		}
+		if rule.EndKey != "" {
+			if end, err = hex.DecodeString(rule.EndKey); err != nil {
+				return "", "", fmt.Errorf("rule %s: invalid end_key %q", rule.Name, rule.EndKey)
+			}
+		}
+	default:
+		return "", "", fmt.Errorf("rule %s: only one of prefix, hex_prefix and start_key/end_key can be given", rule.Name)
+	}
+	startKey, endKey = set.regionKey(start), set.regionKey(end)
+	if startKey >= endKey {
+		return "", "", fmt.Errorf("rule %s: start key is not before end key", rule.Name)
+	}
+	return startKey, endKey, nil
+}
+
+// compile validates the rules, and converts them into labeled intervals
+func (set *LabelRuleSet) compile() ([]*labelInterval, error) {
+	if set.Mode != "" && set.Mode != labelRuleModeAppend && set.Mode != labelRuleModeReplace {
+		return nil, fmt.Errorf("invalid mode %q, expect %s or %s", set.Mode, labelRuleModeAppend, labelRuleModeReplace)
+	}
+	intervals := make([]*labelInterval, 0)
+	var walk func(rules []*LabelRule, parent *KeyLabel) error
+	walk = func(rules []*LabelRule, parent *KeyLabel) error {
+		for _, rule := range rules {
+			if rule.Name == "" || strings.Contains(rule.Name, "/") {
+				return fmt.Errorf("invalid rule name %q", rule.Name)
+			}
+			startKey, endKey, err := set.keyRange(rule)
+			if err != nil {
+				return err
+			}
+			label := &KeyLabel{
+				Kind:     labelKindRule,
+				Rule:     rule.Name,
+				StartKey: startKey,
+				EndKey:   endKey,
+			}
+			if parent != nil {
+				if startKey < parent.StartKey || endKey > parent.EndKey {
+					return fmt.Errorf("rule %s is out of the range of its parent %s", rule.Name, parent.Rule)
+				}
+				label.Rule = parent.Rule + "/" + rule.Name
+			}
+			intervals = append(intervals, &labelInterval{label: label})
+			if err := walk(rule.Children, label); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(set.Rules, nil); err != nil {
+		return nil, err
+	}
+	return intervals, nil
+}
+
+// isYAML checks if a rule file is in YAML format according to its extension, otherwise it is in JSON format
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// unmarshalRuleFile parses the content of a rule file in JSON or YAML format
+func unmarshalRuleFile(path string, data []byte, v interface{}) error {
+	if isYAML(path) {
+		return yaml.Unmarshal(data, v)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeRuleFile saves v into a rule file in JSON or YAML format
+func writeRuleFile(path string, v interface{}) error {
+	var data []byte
+	var err error
+	if isYAML(path) {
+		data, err = yaml.Marshal(v)
+	} else {
+		data, err = json.MarshalIndent(v, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// parseLabelRuleSet parses a label rule file in JSON or YAML format according to its extension
+func parseLabelRuleSet(path string, data []byte) (*LabelRuleSet, error) {
+	set := &LabelRuleSet{}
+	err := unmarshalRuleFile(path, data, set)
+	return set, err
+}
+
+// LabelRuleStore keeps the label rules in effect, and saves them into the rule file if there is one
+type LabelRuleStore struct {
+	sync.RWMutex
+	path  string
+	set   *LabelRuleSet
+	index *LabelIndex
+}
+
+var labelRules = LabelRuleStore{
+	set:   &LabelRuleSet{},
+	index: newLabelIndex(nil),
+}
+
+// Load loads the rules from the file, which is also used to save the rules changed through API
+// a missing file is regarded as empty, and will be created when the rules are changed
+func (s *LabelRuleStore) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		s.Lock()
+		s.path = path
+		s.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	set, err := parseLabelRuleSet(path, data)
+	if err != nil {
+		return fmt.Errorf("parse %s: %s", path, err.Error())
+	}
+	s.Lock()
+	s.path = path
+	s.Unlock()
+	return s.update(set, false)
+}
+
+// Reload loads the rules from the file again. The rules are cleared if path is empty, or if the file is missing
+// or unreadable, whose error is returned. The rules are kept if the file is invalid.
+func (s *LabelRuleStore) Reload(path string) error {
+	var err error
+	if path != "" {
+		if _, err = ioutil.ReadFile(path); err == nil {
+			return s.Load(path)
+		}
+	}
+	s.Lock()
+	s.path = path
+	s.Unlock()
+	if clearErr := s.update(&LabelRuleSet{}, false); clearErr != nil {
+		return clearErr
+	}
+	return err
+}
+
+// update validates the rules and puts them in effect, they are saved into the rule file if save is true
+func (s *LabelRuleStore) update(set *LabelRuleSet, save bool) error {
+	intervals, err := set.compile()
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if save && s.path != "" {
+		if err := writeRuleFile(s.path, set); err != nil {
+			return err
+		}
+	}
+	s.set = set
+	s.index = newLabelIndex(intervals)
+	return nil
+}
+
+// get returns the rules in effect and the index of them
+func (s *LabelRuleStore) get() (*LabelRuleSet, *LabelIndex) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.set, s.index
+}
+
+// Query returns the labels of rules which overlap [startKey, endKey),
+// and whether they replace the labels of TiDB tables
+func (s *LabelRuleStore) Query(startKey string, endKey string) (labels []*KeyLabel, replace bool) {
+	set, index := s.get()
+	return index.Query(startKey, endKey, time.Time{}, time.Time{}), set.Mode == labelRuleModeReplace
+}
+
+// labelRulesHandler gets the rules by GET, replaces the rules by PUT with a JSON body, and removes all rules by DELETE
+func labelRulesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		set, _ := labelRules.get()
+		writeJSON(w, set)
+	case http.MethodPut:
+		var set LabelRuleSet
+		if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := set.compile(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := labelRules.update(&set, true); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, &set)
+	case http.MethodDelete:
+		if err := labelRules.update(&LabelRuleSet{}, true); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
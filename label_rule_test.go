@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testlabelruletablepath = "../test/label_rule_table"
+
+func TestPrefixNext(t *testing.T) {
+	cases := []struct {
+		prefix []byte
+		expect []byte
+	}{
+		{[]byte("u_"), []byte("u`")},
+		{[]byte{1, 0xFF}, []byte{2}},
+		{[]byte{0xFF, 0xFF}, nil},
+	}
+	for _, c := range cases {
+		if result := prefixNext(c.prefix); !reflect.DeepEqual(result, c.expect) {
+			t.Fatalf("prefixNext %v: expect %v, but got %v", c.prefix, c.expect, result)
+		}
+	}
+}
+
+func TestLabelRuleSet_compile(t *testing.T) {
+	rawKey := func(s string) string {
+		return strings.ToUpper(hex.EncodeToString([]byte(s)))
+	}
+	set := &LabelRuleSet{
+		Rules: []*LabelRule{
+			{Name: "user", Prefix: "u_", Children: []*LabelRule{
+				{Name: "profile", HexPrefix: hex.EncodeToString([]byte("u_p"))},
+			}},
+			{Name: "tail", StartKey: hex.EncodeToString([]byte("z"))},
+		},
+	}
+	intervals, err := set.compile()
+	perr(err)
+	expect := []KeyLabel{
+		{Kind: labelKindRule, Rule: "user", StartKey: rawKey("u_"), EndKey: rawKey("u`")},
+		{Kind: labelKindRule, Rule: "user/profile", StartKey: rawKey("u_p"), EndKey: rawKey("u_q")},
+		{Kind: labelKindRule, Rule: "tail", StartKey: rawKey("z"), EndKey: "~"},
+	}
+	for i, interval := range intervals {
+		if !reflect.DeepEqual(*interval.label, expect[i]) {
+			t.Fatalf("expect %v, but got %v", expect[i], *interval.label)
+		}
+	}
+
+	// keys of TxnKV are encoded
+	set.Encoded = true
+	intervals, err = set.compile()
+	perr(err)
+	if intervals[0].label.StartKey != strings.ToUpper(hex.EncodeToString(EncodeBytes([]byte("u_")))) {
+		t.Fatalf("expect encoded key, but got %s", intervals[0].label.StartKey)
+	}
+
+	for _, invalid := range []*LabelRuleSet{
+		{Mode: "override"},
+		{Rules: []*LabelRule{{Name: "", Prefix: "a"}}},
+		{Rules: []*LabelRule{{Name: "a/b", Prefix: "a"}}},
+		{Rules: []*LabelRule{{Name: "a", Prefix: "a", HexPrefix: "61"}}},
+		{Rules: []*LabelRule{{Name: "a", HexPrefix: "xyz"}}},
+		{Rules: []*LabelRule{{Name: "a", StartKey: "62", EndKey: "61"}}},
+		{Rules: []*LabelRule{{Name: "a", Prefix: "a", Children: []*LabelRule{{Name: "b", Prefix: "b"}}}}},
+	} {
+		if _, err := invalid.compile(); err == nil {
+			t.Fatalf("expect error for %v", invalid)
+		}
+	}
+}
+
+func TestLabelRuleStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "label-rules")
+	perr(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.yaml")
+	perr(ioutil.WriteFile(path, []byte(`
+mode: replace
+rules:
+  - name: user
+    prefix: u_
+`), 0644))
+
+	perr(labelRules.Load(path))
+	defer func() {
+		perr(labelRules.update(&LabelRuleSet{}, false))
+		labelRules.path = ""
+	}()
+	labels, replace := labelRules.Query(strings.ToUpper(hex.EncodeToString([]byte("u_1"))), "~")
+	if !replace || len(labels) != 1 || labels[0].Rule != "user" {
+		t.Fatalf("error query, get %v, %v", labels, replace)
+	}
+
+	// rules changed through API are saved into the file
+	recorder := httptest.NewRecorder()
+	body := `{"mode": "append", "rules": [{"name": "order", "prefix": "o_"}]}`
+	labelRulesHandler(recorder, httptest.NewRequest("PUT", "/api/v1/label-rules", bytes.NewBufferString(body)))
+	if recorder.Code != 200 {
+		t.Fatalf("expect 200, but got %d, %s", recorder.Code, recorder.Body.String())
+	}
+	var store LabelRuleStore
+	perr(store.Load(path))
+	set, _ := store.get()
+	if set.Mode != labelRuleModeAppend || len(set.Rules) != 1 || set.Rules[0].Name != "order" {
+		t.Fatalf("error saved rules %v", set)
+	}
+
+	recorder = httptest.NewRecorder()
+	body = `{"rules": [{"name": "order"}]}`
+	labelRulesHandler(recorder, httptest.NewRequest("PUT", "/api/v1/label-rules", bytes.NewBufferString(body)))
+	if recorder.Code != 400 {
+		t.Fatalf("expect 400, but got %d", recorder.Code)
+	}
+
+	// the rules are cleared on reloading if the path is removed, or if the file is missing
+	perr(store.Reload(path))
+	if set, _ = store.get(); len(set.Rules) != 1 {
+		t.Fatalf("expect the rules are reloaded, but got %v", set)
+	}
+	perr(store.Reload(""))
+	if set, _ = store.get(); len(set.Rules) != 0 || store.path != "" {
+		t.Fatalf("expect the rules are cleared, but got %v", set)
+	}
+	perr(store.Load(path))
+	perr(os.Remove(path))
+	if err := store.Reload(path); err == nil {
+		t.Fatalf("expect error when the rule file is missing")
+	}
+	if set, _ = store.get(); len(set.Rules) != 0 {
+		t.Fatalf("expect the rules are cleared, but got %v", set)
+	}
+}
+
+func TestQueryLabels(t *testing.T) {
+	openTestTables(testlabelruletablepath)
+	defer tables.LeveldbStorage.Close()
+	saveTestTables(
+		&Table{Name: "orders", DB: "sales", ID: 45, Indices: map[int64]string{}},
+		&Table{Name: "users", DB: "sales", ID: 46, Indices: map[int64]string{}},
+	)
+	// the rule covers the range of users, next to orders
+	set := &LabelRuleSet{Mode: labelRuleModeReplace, Rules: []*LabelRule{
+		{Name: "user", StartKey: GenTablePrefix(46), EndKey: GenTablePrefix(47)},
+	}}
+	perr(labelRules.update(set, false))
+	defer func() { perr(labelRules.update(&LabelRuleSet{}, false)) }()
+
+	names := func(labels []*KeyLabel) []string {
+		result := make([]string, 0, len(labels))
+		for _, label := range labels {
+			result = append(result, label.String())
+		}
+		return result
+	}
+	now := time.Now()
+	// the labels of tables are kept out of the range of the rule
+	labels := queryLabels(tables.labelIndex(), GenTablePrefix(45), "~", now, now)
+	if expect := []string{"sales.orders", "rule user"}; !reflect.DeepEqual(names(labels), expect) {
+		t.Fatalf("expect %v, but got %v", expect, names(labels))
+	}
+	labels = queryLabels(tables.labelIndex(), GenTableRecordPrefix(46), GenTablePrefix(47), now, now)
+	if expect := []string{"rule user"}; !reflect.DeepEqual(names(labels), expect) {
+		t.Fatalf("expect %v, but got %v", expect, names(labels))
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	labelNodeDB        = "db"
+	labelNodeTable     = "table"
+	labelNodePartition = "partition"
+)
+
+// LabelNode is a node of the label tree of a heatmap, which is
+// database -> table -> partition -> data/index for TiDB tables, or the nested label rules
+type LabelNode struct {
+	Kind     string       `json:"kind"` // "db", "table", "partition", "data", "index" or "rule"
+	Name     string       `json:"name"`
+	State    string       `json:"state,omitempty"` // "dropped" or "truncated" of a table which has ended
+	StartKey string       `json:"start_key"`
+	EndKey   string       `json:"end_key"`
+	StartRow int          `json:"start_row"` // the rows of the heatmap covered by the node are [StartRow, EndRow)
+	EndRow   int          `json:"end_row"`
+	Children []*LabelNode `json:"children,omitempty"`
+}
+
+// extend makes the node cover the key range and the row
+func (node *LabelNode) extend(startKey string, endKey string, row int) {
+	if node.EndRow == 0 {
+		node.StartKey, node.EndKey = startKey, endKey
+		node.StartRow, node.EndRow = row, row+1
+		return
+	}
+	if startKey < node.StartKey {
+		node.StartKey = startKey
+	}
+	if endKey > node.EndKey {
+		node.EndKey = endKey
+	}
+	if row < node.StartRow {
+		node.StartRow = row
+	}
+	if row+1 > node.EndRow {
+		node.EndRow = row + 1
+	}
+}
+
+type labelTreeBuilder struct {
+	roots []*LabelNode
+	nodes map[string]*LabelNode
+}
+
+// child returns the child of parent identified by kind, name and state, which is created if not exists
+func (b *labelTreeBuilder) child(parent *LabelNode, path string, kind string, name string, state string) (*LabelNode, string) {
+	path = path + "/" + kind + ":" + state + ":" + name
+	if node, ok := b.nodes[path]; ok {
+		return node, path
+	}
+	node := &LabelNode{Kind: kind, Name: name, State: state}
+	b.nodes[path] = node
+	if parent == nil {
+		b.roots = append(b.roots, node)
+	} else {
+		parent.Children = append(parent.Children, node)
+	}
+	return node, path
+}
+
+// path returns the nodes from the root to the leaf of a label
+func (b *labelTreeBuilder) path(label *KeyLabel) []*LabelNode {
+	type step struct{ kind, name, state string }
+	var steps []step
+	switch label.Kind {
+	case labelKindRule:
+		for _, name := range strings.Split(label.Rule, "/") {
+			steps = append(steps, step{labelKindRule, name, ""})
+		}
+	default:
+		steps = append(steps, step{labelNodeDB, label.DB, ""}, step{labelNodeTable, label.Table, label.State})
+		if label.Partition != "" {
+			steps = append(steps, step{labelNodePartition, label.Partition, ""})
+		}
+		steps = append(steps, step{label.Kind, label.Index, ""})
+	}
+	nodes := make([]*LabelNode, 0, len(steps))
+	var parent *LabelNode
+	path := ""
+	for _, s := range steps {
+		parent, path = b.child(parent, path, s.kind, s.name, s.state)
+		nodes = append(nodes, parent)
+	}
+	return nodes
+}
+
+// buildLabelTree groups the labels of the rows of a heatmap into a tree,
+// each node covers the key ranges and the rows of the labels under it
+func buildLabelTree(labels []*Label) []*LabelNode {
+	b := &labelTreeBuilder{nodes: make(map[string]*LabelNode)}
+	for row, label := range labels {
+		for _, name := range label.Names {
+			for _, node := range b.path(name) {
+				node.extend(name.StartKey, name.EndKey, row)
+			}
+		}
+	}
+	sortLabelNodes(b.roots)
+	return b.roots
+}
+
+func sortLabelNodes(nodes []*LabelNode) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if nodes[i].StartKey != nodes[j].StartKey {
+			return nodes[i].StartKey < nodes[j].StartKey
+		}
+		return nodes[i].EndKey > nodes[j].EndKey
+	})
+	for _, node := range nodes {
+		sortLabelNodes(node.Children)
+	}
+}
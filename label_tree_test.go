@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBuildLabelTree(t *testing.T) {
+	data := func(partition string) *KeyLabel {
+		return &KeyLabel{Kind: labelKindData, DB: "sales", Table: "orders", Partition: partition, StartKey: partition + "r", EndKey: partition + "s"}
+	}
+	index := func(partition string) *KeyLabel {
+		return &KeyLabel{Kind: labelKindIndex, DB: "sales", Table: "orders", Partition: partition, Index: "idx", StartKey: partition + "i", EndKey: partition + "j"}
+	}
+	labels := []*Label{
+		{Names: []*KeyLabel{}},
+		{Names: []*KeyLabel{index("0")}},
+		{Names: []*KeyLabel{data("0"), index("1")}},
+		{Names: []*KeyLabel{data("1"), {Kind: labelKindRule, Rule: "hot", StartKey: "1r", EndKey: "2"}}},
+		{Names: []*KeyLabel{{Kind: labelKindRule, Rule: "hot", StartKey: "1r", EndKey: "2"}, {Kind: labelKindRule, Rule: "hot/tail", StartKey: "1s", EndKey: "2"}}},
+	}
+	var lines []string
+	var walk func(nodes []*LabelNode, depth int)
+	walk = func(nodes []*LabelNode, depth int) {
+		for _, node := range nodes {
+			lines = append(lines, fmt.Sprintf("%s%s %s [%s, %s) [%d, %d)", strings.Repeat("  ", depth),
+				node.Kind, node.Name, node.StartKey, node.EndKey, node.StartRow, node.EndRow))
+			walk(node.Children, depth+1)
+		}
+	}
+	walk(buildLabelTree(labels), 0)
+	expect := []string{
+		"db sales [0i, 1s) [1, 4)",
+		"  table orders [0i, 1s) [1, 4)",
+		"    partition 0 [0i, 0s) [1, 3)",
+		"      index idx [0i, 0j) [1, 2)",
+		"      data  [0r, 0s) [2, 3)",
+		"    partition 1 [1i, 1s) [2, 4)",
+		"      index idx [1i, 1j) [2, 3)",
+		"      data  [1r, 1s) [3, 4)",
+		"rule hot [1r, 2) [3, 5)",
+		"  rule tail [1s, 2) [4, 5)",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("expect\n%s\nbut got\n%s", strings.Join(expect, "\n"), strings.Join(lines, "\n"))
+	}
+}
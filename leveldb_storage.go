@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/pingcap/goleveldb/leveldb"
 	"github.com/pingcap/goleveldb/leveldb/iterator"
+	"github.com/pingcap/goleveldb/leveldb/util"
 )
 
 type LeveldbStorage struct {
@@ -44,6 +45,50 @@ func (db *LeveldbStorage) Search(k []byte) iterator.Iterator {
 	return nil
 }
 
+// Bounds returns the smallest and the biggest key in the storage, both are nil if the storage is empty
+func (db *LeveldbStorage) Bounds() (first []byte, last []byte) {
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	if iter.First() {
+		first = append([]byte(nil), iter.Key()...)
+	}
+	if iter.Last() {
+		last = append([]byte(nil), iter.Key()...)
+	}
+	return first, last
+}
+
+// Scan calls fn with the key-value pairs in [startKey, endKey) in order, until fn returns false.
+// The pairs are read from a snapshot, so that fn may take a long time without blocking writes.
+func (db *LeveldbStorage) Scan(startKey, endKey []byte, fn func(key, value []byte) bool) error {
+	iter := db.NewIterator(&util.Range{Start: startKey, Limit: endKey}, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !fn(iter.Key(), iter.Value()) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+// DeleteRange deletes the keys in [startKey, endKey) in a batch, and returns the amount of deleted keys.
+// A nil key means no bound.
+func (db *LeveldbStorage) DeleteRange(startKey, endKey []byte) (int, error) {
+	batch := new(leveldb.Batch)
+	iter := db.NewIterator(&util.Range{Start: startKey, Limit: endKey}, nil)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	if batch.Len() == 0 {
+		return 0, nil
+	}
+	return batch.Len(), db.Write(batch, nil)
+}
+
 // Traversal return a traversal of the storage
 func (db *LeveldbStorage) Traversal() (allValues []string) {
 	iter := db.NewIterator(nil, nil)
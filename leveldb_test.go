@@ -129,3 +129,17 @@ func TestLeveldbStorage_LoadRange(t *testing.T) {
 		t.Fatalf("error loadrange, get keys:%v", newKeys)
 	}
 }
+
+func TestLeveldbStorage_DeleteRange(t *testing.T) {
+	db, err := NewLeveldbStorage("test/store/deleterange")
+	perr(err)
+	defer db.Close()
+	for i := range keys {
+		perr(db.Save([]byte(keys[i]), []byte(values[i])))
+	}
+	n, err := db.DeleteRange(nil, []byte(keys[2]))
+	perr(err)
+	if n != 2 || !reflect.DeepEqual(db.Traversal(), values[2:]) {
+		t.Fatalf("error delete range, deleted %d, left %v", n, db.Traversal())
+	}
+}
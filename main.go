@@ -4,52 +4,162 @@ import (
 	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/rs/cors"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 )
 
 var (
+	// the config file, whose keys are the names of these flags
+	configPath = flag.String("config", "", "Path of the config file in TOML, YAML or JSON, the settings can also be given by KEYVISUAL_<FLAG> variables")
 	// the IP address and port number that this server listen on
 	addr = flag.String("addr", "0.0.0.0:8000", "Listening address")
 	// PD Server address
 	pdAddr = flag.String("pd", "http://172.16.4.191:8010", "PD address")
-	// TiDB Server address
-	tidbAddr = flag.String("tidb", "http://172.16.4.191:10080", "TiDB Address")
+	// TiDB Server addresses, requests fail over among them
+	tidbAddr = flag.String("tidb", "http://172.16.4.191:10080", "TiDB status addresses, separated by comma")
 	//interval
 	interval = flag.Duration("I", time.Minute, "Interval to collect metrics")
+	// interval to check whether the schema of TiDB changes
+	schemaInterval = flag.Duration("schema-interval", time.Minute, "Interval to check the schema version of TiDB")
+	// the maximum amount of concurrent requests to TiDB when synchronizing schema
+	schemaConcurrency = flag.Int("schema-concurrency", 4, "Maximum concurrent requests to TiDB when synchronizing schema")
+	// the minimum value and the minimum ratio to its neighbours or its history of a hotspot
+	hotspotThreshold = flag.Uint64("hotspot-threshold", 1<<20, "Minimum written or read bytes of a hotspot in an interval")
+	hotspotRatio     = flag.Float64("hotspot-ratio", 5, "Minimum ratio of a hotspot to its neighbours or its history")
+	// the file of user-defined label rules
+	labelRulePath = flag.String("label-rules", "", "Path of the label rule file in JSON or YAML")
+	// the file of alert rules
+	alertRulePath = flag.String("alert-rules", "", "Path of the alert rule file in JSON or YAML")
+	// the maximum amount of tables exported as metrics, the others are summed up
+	metricsTableLimit = flag.Int("metrics-table-limit", 100, "Maximum tables exported to /metrics, the others are summed up")
+	// the maximum amount of cached heatmaps
+	cacheSize = flag.Int("cache-size", 64, "Maximum heatmaps cached, 0 disables the cache")
+	// the limits of the resolution of a heatmap
+	maxDisplayTimes = flag.Int("max-display-times", 50, "Maximum columns on the time axis of a heatmap")
+	maxDisplayKeys  = flag.Int("max-display-keys", 80, "Maximum rows on the key axis of a heatmap")
+	// the directory of the levelDbs
+	storageDir = flag.String("storage", "../storage", "Directory of the region, table and hotspot storage")
+	// how long the collected axes are kept
+	retention = flag.Duration("retention", 0, "Time to keep the collected axes, the ended table versions and the hotspot events, 0 keeps them forever")
+	// the certificates to serve HTTPS and to request PD and TiDB
+	tlsCA   = flag.String("tls-ca", "", "Path of the CA certificate to verify PD and TiDB")
+	tlsCert = flag.String("tls-cert", "", "Path of the certificate to serve HTTPS and to present to PD and TiDB")
+	tlsKey  = flag.String("tls-key", "", "Path of the key of the certificate")
+	// the tokens accepted by the API
+	authTokens = flag.String("auth-tokens", "", "Bearer tokens accepted by the API, separated by comma, empty disables authentication")
+	// the time to wait for the in-flight requests when shutting down
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "Time to wait for in-flight requests when shutting down")
 )
 
-func handler(w http.ResponseWriter, r *http.Request) {
+// version of this server, which can be overridden by -ldflags "-X main.version=xxx" when building
+var version = "None"
+
+// writeJSON encodes v as the json body of the response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-type", "application/json")
-	startKey := r.FormValue("startkey")
-	endKey := r.FormValue("endkey")
-	start := r.FormValue("starttime")
-	end := r.FormValue("endtime")
-	endTime := time.Now()
-	startTime := endTime.Add(-60 * time.Minute)
+	// the client may have gone away, which should not bring the server down
+	_, err = w.Write(data)
+	lerr(err)
+}
+
+// requestHeatmap generates the heatmap requested by the form of r, or writes the error into w and returns false.
+// defaultTag is used if no tag is given.
+func requestHeatmap(w http.ResponseWriter, r *http.Request, defaultTag string) (*Heatmap, bool) {
 	// tag indicates the type of data request(e.g. read or write)
 	tag := r.FormValue("tag")
+	if tag == "" {
+		tag = defaultTag
+	}
 	// mode indicates the mod of data statistics(e.g. max or average)
 	mode := r.FormValue("mode")
 
-	if start != "" {
-		if d, err := time.ParseDuration(start); err == nil {
-			startTime = endTime.Add(d)
-		}
+	startTime, endTime, err := parseTimeRange(r.FormValue("starttime"), r.FormValue("endtime"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
 	}
-	if end != "" {
-		if d, err := time.ParseDuration(end); err == nil {
-			endTime = endTime.Add(d)
-		}
+	startKey, endKey, err := parseKeyRange(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
 	}
-	if endKey == "" {
-		endKey = "~" // \126, which is the biggest displayable character
+	if err := globalRegionStore.CheckRange(startTime, endTime); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
 	}
-	matrix := GenerateHeatmap(startTime, endTime, startKey, endKey, tag, mode)
-	data, _ := json.Marshal(matrix)
-	_, err := w.Write(data)
-	perr(err)
+	return heatmapCache.Generate(startTime, endTime, startKey, endKey, tag, mode), true
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	// format indicates the format of the response, which is json by default
+	format := r.FormValue("format")
+	if format == "" {
+		format = formatJSON
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("invalid format %q, expect %s, %s or %s", format, formatJSON, formatCSV, formatArrow), http.StatusBadRequest)
+		return
+	}
+	matrix, ok := requestHeatmap(w, r, "")
+	if !ok {
+		return
+	}
+	if format == formatJSON {
+		writeJSON(w, matrix)
+		return
+	}
+	// the output is streamed, so that an error can only be logged after the response begins
+	w.Header().Set("Content-type", contentType)
+	lerr(exportHeatmap(w, matrix, format, r.FormValue("tag")))
+}
+
+// collect scans the regions and stores them as an axis. The open cached heatmaps are invalidated, and the axis is
+// pushed to the subscribers, checked for hotspots and alerts, and exported as metrics.
+// The scan is abandoned if ctx is canceled.
+func collect(ctx context.Context) {
+	start := time.Now()
+	regions, err := ScanRegions(ctx)
+	scanDuration.Observe(time.Since(start).Seconds())
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		collectionFailures.Inc()
+		lerr(err)
+		return
+	}
+	scanRegionCount.Set(float64(len(regions)))
+	axis := globalRegionStore.Append(regions)
+	heatmapCache.InvalidateOpen()
+	axisStream.publish(axis)
+	now := time.Now()
+	if *retention > 0 {
+		expired := now.Add(-*retention)
+		_, err := globalRegionStore.DeleteBefore(expired)
+		lerr(err)
+		_, err = tables.pruneBefore(expired)
+		lerr(err)
+		_, err = hotspots.DeleteBefore(expired)
+		lerr(err)
+	}
+	hotspots.Detect(axis, now)
+	alertRules.Evaluate(axis, now)
+	updateTableMetrics(axis, *metricsTableLimit)
 }
 
 func updateStat(ctx context.Context) {
@@ -61,27 +171,137 @@ func updateStat(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			regions := ScanRegions()
-			globalRegionStore.Append(regions)
-			updateTables()
+			collect(ctx)
+		case <-reloads:
+			reloadConfig()
 		}
 	}
 }
 
+// openStores opens the levelDbs under dir, and inserts an empty axis, which means that from the last time the
+// server shutdown till now the data is zero
+func openStores(dir string) error {
+	var err error
+	if globalRegionStore.LeveldbStorage, err = NewLeveldbStorage(filepath.Join(dir, "region")); err != nil {
+		return err
+	}
+	tableStorage, err := NewLeveldbStorage(filepath.Join(dir, "table"))
+	if err != nil {
+		return err
+	}
+	tables.open(tableStorage)
+	hotspotStorage, err := NewLeveldbStorage(filepath.Join(dir, "hotspot"))
+	if err != nil {
+		return err
+	}
+	if err = hotspots.open(hotspotStorage); err != nil {
+		return err
+	}
+	globalRegionStore.Append([]*regionInfo{{StartKey: "", EndKey: "~"}})
+	return nil
+}
+
 func main() {
 	flag.Parse()
-	// update data loop
-	go updateStat(context.Background())
+	perr(loadConfig(flag.CommandLine))
+	serverTLS, err := loadTLS()
+	perr(err)
+	perr(openStores(*storageDir))
+	apiTokens.set(*authTokens)
+	perr(loadRules())
+	// the background loops and the requests to PD and TiDB are canceled when shutting down
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, loop := range []func(context.Context){
+		// update data loop
+		updateStat,
+		// synchronize schema loop
+		syncSchema,
+		checkTidbHealth,
+		notifyAlerts,
+	} {
+		wg.Add(1)
+		go func(loop func(context.Context)) {
+			defer wg.Done()
+			loop(ctx)
+		}(loop)
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/heatmaps", handler)
+	mux.HandleFunc("/heatmaps.png", renderHandler("image/png", renderPNG))
+	mux.HandleFunc("/heatmaps.svg", renderHandler("image/svg+xml", renderSVG))
+	mux.HandleFunc("/heatmaps/diff", diffHandler)
+	mux.HandleFunc("/heatmaps/stream", streamHandler)
+	mux.HandleFunc("/api/v1/meta", metaHandler)
+	mux.HandleFunc("/api/v1/regions/history", regionHistoryHandler)
+	mux.HandleFunc("/api/v1/topn", topNHandler)
+	mux.HandleFunc("/api/v1/hotspots", hotspotsHandler)
+	mux.HandleFunc("/api/v1/series", seriesHandler)
+	mux.HandleFunc("/api/v1/grafana/", grafanaHandler("/api/v1/grafana"))
+	mux.HandleFunc("/api/v1/label-rules", labelRulesHandler)
+	mux.HandleFunc("/api/v1/alert-rules", alertRulesHandler)
+	mux.HandleFunc("/api/v1/alerts", alertsHandler)
+	mux.Handle("/metrics", metricsHandler())
 
-	// cors.Default() setup the middleware with default options being
-	// all origins accepted with simple methods (GET, POST). See
-	// documentation below for more options.
-	handler := cors.Default().Handler(mux)
+	// setup the middleware with all origins accepted,
+	// PUT and DELETE are allowed for managing label rules and alert rules.
+	// The preflight requests are answered before authentication, since they carry no token.
+	handler := cors.New(cors.Options{
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+	}).Handler(authHandler(mux))
+	handler = instrumentHandler(mux, handler)
 
-	_ = http.ListenAndServe(*addr, handler)
-	// close the two levelDbs
-	globalRegionStore.Close()
-	tables.Close()
+	server := &http.Server{
+		Addr:      *addr,
+		Handler:   handler,
+		TLSConfig: serverTLS,
+		// the long-lived requests such as the streams of axes end once ctx is canceled
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	server.RegisterOnShutdown(cancel)
+	serveErr := make(chan error, 1)
+	go func() {
+		if serverTLS != nil {
+			serveErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	failed := false
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				select {
+				case reloads <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			log.Printf("received %s, shutting down", sig)
+			shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), *shutdownTimeout)
+			lerr(server.Shutdown(shutdownCtx))
+			cancelShutdown()
+		case err := <-serveErr:
+			lerr(err)
+			failed = true
+		}
+		break
+	}
+	signal.Stop(signals)
+
+	// wait for the background loops before closing the levelDbs they write to
+	cancel()
+	wg.Wait()
+	lerr(globalRegionStore.Close())
+	lerr(tables.Close())
+	lerr(hotspots.Close())
+	if failed {
+		os.Exit(1)
+	}
 }
@@ -105,24 +105,11 @@ func (plane *DiscretePlane) TimesSquash(n int) *DiscretePlane {
 
 	// divide time axises equally and then compress
 	if len(plane.Axes) >= n {
-		// compression are two processes, the first one has a bigger step, the next one has a smaller step
-		step2 := len(plane.Axes) / n
-		step1 := step2 + 1
-		n1 := len(plane.Axes) % n
-		var index int
-		var step int
-
-		for i := 0; i < n; i++ {
-			if i < n1 {
-				step = step1
-				index = i * step1
-			} else {
-				step = step2
-				index = n1*step1 + (i-n1)*step2
-			}
+		index := 0
+		for _, step := range squashSteps(len(plane.Axes), n) {
 			// merge the step key axises
 			tempPlane := &DiscretePlane{}
-			if i == 0 {
+			if index == 0 {
 				tempPlane.StartTime = plane.StartTime
 			} else {
 				tempPlane.StartTime = plane.Axes[index-1].EndTime
@@ -134,6 +121,7 @@ func (plane *DiscretePlane) TimesSquash(n int) *DiscretePlane {
 			axis, _ := tempPlane.Compact()
 			// insert the key after merge into newPlane
 			newPlane.Axes = append(newPlane.Axes, axis)
+			index += step
 		}
 	} else {
 		newPlane.Axes = make([]*DiscreteAxis, len(plane.Axes))
@@ -144,6 +132,24 @@ func (plane *DiscretePlane) TimesSquash(n int) *DiscretePlane {
 	return newPlane
 }
 
+// squashSteps divides length axises into n groups, and returns the amount of axises of each group,
+// the groups in the front have one more axis than the others if length is not divisible by n
+func squashSteps(length int, n int) []int {
+	// compression are two processes, the first one has a bigger step, the next one has a smaller step
+	step2 := length / n
+	step1 := step2 + 1
+	n1 := length % n
+	steps := make([]int, n)
+	for i := 0; i < n; i++ {
+		if i < n1 {
+			steps[i] = step1
+		} else {
+			steps[i] = step2
+		}
+	}
+	return steps
+}
+
 // pixel the plane into a n*m matrix at the given n and m
 func (plane *DiscretePlane) Pixel(n int, m int) *Matrix {
 	if n == 0 || m == 0 {
@@ -0,0 +1,217 @@
+package matrix
+
+import (
+	"math"
+	"time"
+)
+
+// the default ratio of the columns which can change before the key axis of a SlidingPlane is rebuilt
+const DefaultDriftRatio = 0.1
+
+// SlidingPlane keeps the pixelation of a sliding window of key axises, so that moving the window only squashes
+// and projects the new axises instead of pixeling the whole plane again.
+//
+// It is built by the same computation as Pixel, and its results differ from the ones of Pixel on the moved window
+// within the following tolerance:
+//   - a column keeps the axises it has been squashed from, so the new columns have a fixed amount of axises rather
+//     than being divided equally, and a column expires only when all of its axises are before the window,
+//     i.e. the first column may cover up to step-1 axises before the window.
+//   - the last column may be being squashed, which is shown in addition to n full columns, and if there are
+//     more than n full columns, the two adjacent ones with the fewest axises are compacted into one.
+//   - the key axis is rebuilt by BinaryCompress only when more than DriftRatio*n columns have been added or removed
+//     since it was built, before which the new columns are projected onto the old key axis.
+//
+// Given the same columns and a key axis just rebuilt, the result is the same as Pixel.
+type SlidingPlane struct {
+	n          int
+	m          int
+	step       int
+	DriftRatio float64
+
+	startTime time.Time
+	columns   []*slidingColumn
+	// the united key axis whose values are reset
+	keyAxis *DiscreteAxis
+	// the amount of columns added or removed since the key axis was built
+	drift int
+}
+
+// a column of a SlidingPlane, which is squashed from count axises
+type slidingColumn struct {
+	axis  *DiscreteAxis
+	count int
+	// the axises of the column, kept only if the column has fewer than step axises and more may be squashed into it
+	axises []*DiscreteAxis
+	// the values projected onto the key axis, nil if the column has not been projected
+	pixel []Value
+}
+
+// NewSlidingPlane pixels the plane into a n*m matrix like Pixel, and keeps the columns for sliding
+func NewSlidingPlane(plane *DiscretePlane, n int, m int) *SlidingPlane {
+	s := &SlidingPlane{
+		n:          n,
+		m:          m,
+		step:       1,
+		DriftRatio: DefaultDriftRatio,
+		startTime:  plane.StartTime,
+	}
+	if n == 0 || m == 0 {
+		return s
+	}
+	if len(plane.Axes) >= n {
+		s.step = len(plane.Axes) / n
+		index := 0
+		for _, step := range squashSteps(len(plane.Axes), n) {
+			s.columns = append(s.columns, newSlidingColumn(plane.Axes[index:index+step]))
+			index += step
+		}
+	} else {
+		for _, axis := range plane.Axes {
+			s.columns = append(s.columns, &slidingColumn{axis: axis, count: 1})
+		}
+	}
+	s.rebuild()
+	return s
+}
+
+func newSlidingColumn(axises []*DiscreteAxis) *slidingColumn {
+	axis, _ := (&DiscretePlane{Axes: axises}).Compact()
+	return &slidingColumn{axis: axis, count: len(axises)}
+}
+
+// Advance squashes the axises after the last column into the plane, and drops the columns before windowStart
+func (s *SlidingPlane) Advance(axises []*DiscreteAxis, windowStart time.Time) {
+	if s.n == 0 || s.m == 0 {
+		return
+	}
+	for _, axis := range axises {
+		s.push(axis)
+	}
+	// a column expires when all of its axises are before the window
+	for len(s.columns) > 0 && s.columns[0].axis.EndTime.Before(windowStart) {
+		s.startTime = s.columns[0].axis.EndTime
+		s.columns = s.columns[1:]
+		s.drift++
+	}
+	for s.fullColumns() > s.n {
+		s.mergeFewest()
+	}
+	if s.keyAxis == nil || float64(s.drift) > math.Ceil(s.DriftRatio*float64(s.n)) {
+		s.rebuild()
+		return
+	}
+	for _, column := range s.columns {
+		if column.pixel == nil {
+			column.pixel = s.project(column.axis)
+		}
+	}
+}
+
+// push squashes an axis into the last column if it is not full, or adds a new column
+func (s *SlidingPlane) push(axis *DiscreteAxis) {
+	if len(s.columns) > 0 {
+		last := s.columns[len(s.columns)-1]
+		if !axis.EndTime.After(last.axis.EndTime) {
+			// the axis has been squashed
+			return
+		}
+		if last.axises != nil && last.count < s.step {
+			axises := append(last.axises, axis)
+			*last = *newSlidingColumn(axises)
+			if last.count < s.step {
+				last.axises = axises
+			}
+			return
+		}
+	}
+	column := &slidingColumn{axis: axis, count: 1}
+	if s.step > 1 {
+		column.axises = []*DiscreteAxis{axis}
+	}
+	s.columns = append(s.columns, column)
+	s.drift++
+}
+
+// fullColumns returns the amount of columns into which no more axis will be squashed
+func (s *SlidingPlane) fullColumns() int {
+	if len(s.columns) > 0 && s.columns[len(s.columns)-1].axises != nil {
+		return len(s.columns) - 1
+	}
+	return len(s.columns)
+}
+
+// mergeFewest compacts the two adjacent full columns with the fewest axises into one
+func (s *SlidingPlane) mergeFewest() {
+	index := 0
+	for i := 1; i < s.fullColumns()-1; i++ {
+		if s.columns[i].count+s.columns[i+1].count < s.columns[index].count+s.columns[index+1].count {
+			index = i
+		}
+	}
+	a, b := s.columns[index], s.columns[index+1]
+	merged := newSlidingColumn([]*DiscreteAxis{a.axis, b.axis})
+	merged.count = a.count + b.count
+	s.columns = append(s.columns[:index+1], s.columns[index+2:]...)
+	s.columns[index] = merged
+	s.drift++
+}
+
+// rebuild generates the united key axis of the columns like Pixel, and projects all the columns onto it
+func (s *SlidingPlane) rebuild() {
+	s.drift = 0
+	axises := make([]*DiscreteAxis, len(s.columns))
+	for i, column := range s.columns {
+		axises[i] = column.axis
+	}
+	axis, _ := (&DiscretePlane{Axes: axises}).Compact()
+	axis.BinaryCompress(s.m)
+	for i := 0; i < len(axis.Lines); i++ {
+		axis.Lines[i].Reset()
+	}
+	s.keyAxis = axis
+	for _, column := range s.columns {
+		column.pixel = s.project(column.axis)
+	}
+}
+
+// project returns the values of axis projected onto the key axis
+func (s *SlidingPlane) project(axis *DiscreteAxis) []Value {
+	dst := s.keyAxis.Clone()
+	axis.DeProjection(dst)
+	values := make([]Value, len(dst.Lines))
+	for i, line := range dst.Lines {
+		values[i] = line.Value
+	}
+	return values
+}
+
+// Matrix returns the current pixelation, nil if there is no column
+func (s *SlidingPlane) Matrix() *Matrix {
+	if len(s.columns) == 0 || s.keyAxis == nil {
+		return nil
+	}
+	matrix := &Matrix{
+		Data:  make([][]Value, len(s.columns)),
+		Keys:  s.keyAxis.GetDiscreteKeys(),
+		Times: make(DiscreteTimes, 0, len(s.columns)+1),
+	}
+	matrix.Times = append(matrix.Times, s.startTime)
+	for i, column := range s.columns {
+		matrix.Data[i] = column.pixel
+		matrix.Times = append(matrix.Times, column.axis.EndTime)
+	}
+	return matrix
+}
+
+// StartTime returns the start time of the first column
+func (s *SlidingPlane) StartTime() time.Time {
+	return s.startTime
+}
+
+// EndTime returns the time of the last squashed axis
+func (s *SlidingPlane) EndTime() time.Time {
+	if len(s.columns) == 0 {
+		return s.startTime
+	}
+	return s.columns[len(s.columns)-1].axis.EndTime
+}
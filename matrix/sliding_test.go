@@ -0,0 +1,82 @@
+package matrix
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// buildRandomAxises builds count axises of random keys and values, one per minute from start
+func buildRandomAxises(r *rand.Rand, start time.Time, count int) []*DiscreteAxis {
+	axises := make([]*DiscreteAxis, count)
+	for i := range axises {
+		keySet := map[string]struct{}{"~": {}}
+		for j := 0; j < 8; j++ {
+			keySet[string(rune('a'+r.Intn(26)))] = struct{}{}
+		}
+		keys := make([]string, 0, len(keySet))
+		for key := range keySet {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		values := make([]uint64, len(keys))
+		for j := range values {
+			values[j] = uint64(r.Intn(100))
+		}
+		axises[i] = BuildDiscreteAxis("", keys, values, start.Add(time.Duration(i+1)*time.Minute))
+	}
+	return axises
+}
+
+func TestSlidingPlane(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	start := time.Unix(1574000000, 0)
+	n, m, step := 4, 6, 3
+	axises := buildRandomAxises(r, start, n*step+4*step+1)
+	window := func(from int, to int) *DiscretePlane {
+		return &DiscretePlane{StartTime: start.Add(time.Duration(from) * time.Minute), Axes: axises[from:to]}
+	}
+
+	sliding := NewSlidingPlane(window(0, n*step), n, m)
+	if expect := window(0, n*step).Pixel(n, m); !reflect.DeepEqual(sliding.Matrix(), expect) {
+		t.Fatalf("expect: %v\nbut got: %v", SprintMatrix(expect), SprintMatrix(sliding.Matrix()))
+	}
+
+	// the key axis is rebuilt after two columns are added and two are dropped, which is the same as Pixel
+	sliding.Advance(axises[n*step:(n+2)*step], axises[2*step].EndTime)
+	if expect := window(2*step, (n+2)*step).Pixel(n, m); !reflect.DeepEqual(sliding.Matrix(), expect) {
+		t.Fatalf("expect: %v\nbut got: %v", SprintMatrix(expect), SprintMatrix(sliding.Matrix()))
+	}
+
+	// a new column is projected onto the old key axis, and the others are kept
+	before := sliding.Matrix()
+	sliding.Advance(axises[(n+2)*step:(n+2)*step+1], axises[2*step].EndTime)
+	after := sliding.Matrix()
+	if !reflect.DeepEqual(after.Keys, before.Keys) || !reflect.DeepEqual(after.Data[:n], before.Data) ||
+		len(after.Data) != n+1 || !after.Times[n+1].Equal(axises[(n+2)*step].EndTime) {
+		t.Fatalf("error matrix after a new axis: %v", SprintMatrix(after))
+	}
+	dst := sliding.keyAxis.Clone()
+	axises[(n+2)*step].DeProjection(dst)
+	for i, line := range dst.Lines {
+		if !line.Value.Equal(after.Data[n][i]) {
+			t.Fatalf("error projection of the new axis: %v", SprintMatrix(after))
+		}
+	}
+
+	// the new column is squashed with the following axises, and the oldest column expires
+	sliding.Advance(axises[(n+2)*step+1:(n+3)*step], axises[3*step].EndTime)
+	if len(sliding.columns) != n || sliding.columns[n-1].count != step || sliding.columns[n-1].axises != nil ||
+		!sliding.startTime.Equal(axises[3*step-1].EndTime) {
+		t.Fatalf("error columns after squashing: %v", SprintMatrix(sliding.Matrix()))
+	}
+
+	// the full columns beyond n are merged, and the column being squashed is kept
+	sliding.Advance(axises[(n+3)*step:], axises[3*step].EndTime)
+	if sliding.fullColumns() != n || len(sliding.columns) != n+1 || sliding.columns[0].count != 2*step ||
+		!sliding.EndTime().Equal(axises[len(axises)-1].EndTime) {
+		t.Fatalf("error columns after merging: %v", SprintMatrix(sliding.Matrix()))
+	}
+}
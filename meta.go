@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Limits indicates the resolution limits of a heatmap
+type Limits struct {
+	MaxTimes int `json:"max_times"` // the maximum amount of columns on the time axis
+	MaxKeys  int `json:"max_keys"`  // the maximum amount of rows on the key axis
+	// the time range of a heatmap is widened to multiples of it, by rounding the start time down and the end time up,
+	// so the response may cover more than the requested range, e.g. "1m0s"
+	TimeAlignment string `json:"time_alignment"`
+}
+
+// Meta describes what this server can provide, so that clients do not need to guess
+type Meta struct {
+	Version      string       `json:"version"`
+	Tags         []*TagInfo   `json:"tags"`
+	Modes        []*ModeInfo  `json:"modes"`
+	EarliestTime *time.Time   `json:"earliest_time"` // nil if no axis has been stored
+	LatestTime   *time.Time   `json:"latest_time"`   // nil if no axis has been stored
+	Interval     string       `json:"interval"`      // the interval to collect regions, e.g. "1m0s"
+	Limits       Limits       `json:"limits"`
+	Schema       SchemaStatus `json:"schema"`
+}
+
+func buildMeta() *Meta {
+	meta := &Meta{
+		Version:  version,
+		Tags:     heatmapTags,
+		Modes:    heatmapModes,
+		Interval: interval.String(),
+		Limits: Limits{
+			MaxTimes: *maxDisplayTimes,
+			MaxKeys:  *maxDisplayKeys,
+			// the same as normaliseTimeRange
+			TimeAlignment: interval.String(),
+		},
+		Schema: getSchemaStatus(),
+	}
+	if earliest, latest, ok := globalRegionStore.TimeRange(); ok {
+		meta.EarliestTime = &earliest
+		meta.LatestTime = &latest
+	}
+	return meta
+}
+
+func metaHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, buildMeta())
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+const testmetapath = "../test/meta"
+
+func TestMetaHandler(t *testing.T) {
+	globalRegionStore.LeveldbStorage, _ = NewLeveldbStorage(testmetapath)
+	defer globalRegionStore.LeveldbStorage.Close()
+	globalRegionStore.Append([]*regionInfo{
+		newRegionInfo("a", "b", 1, 2, 3, 4),
+	})
+
+	recorder := httptest.NewRecorder()
+	metaHandler(recorder, httptest.NewRequest("GET", "/api/v1/meta", nil))
+	var meta Meta
+	err := json.Unmarshal(recorder.Body.Bytes(), &meta)
+	perr(err)
+	if len(meta.Tags) != len(heatmapTags) || len(meta.Modes) != len(heatmapModes) {
+		t.Fatalf("expect %d tags and %d modes, but got %d and %d", len(heatmapTags), len(heatmapModes), len(meta.Tags), len(meta.Modes))
+	}
+	if meta.EarliestTime == nil || meta.LatestTime == nil || meta.LatestTime.Before(*meta.EarliestTime) {
+		t.Fatalf("error time range: %v - %v", meta.EarliestTime, meta.LatestTime)
+	}
+	if meta.Limits.MaxTimes != *maxDisplayTimes || meta.Limits.MaxKeys != *maxDisplayKeys ||
+		meta.Limits.TimeAlignment != interval.String() {
+		t.Fatalf("error limits %v", meta.Limits)
+	}
+	if meta.Interval != interval.String() {
+		t.Fatalf("expect interval %s, but got %s", interval.String(), meta.Interval)
+	}
+}
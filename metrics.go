@@ -0,0 +1,230 @@
+package main
+
+import (
+	"github.com/pingcap/goleveldb/leveldb/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sort"
+)
+
+const (
+	metricsNamespace = "keyvisual"
+	// the table label of the tables beyond *metricsTableLimit, whose values are summed up
+	otherTables = "_others"
+)
+
+var (
+	scanDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "scan_duration_seconds",
+		Help:      "Duration of scanning the regions from PD.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 15),
+	})
+	scanRegionCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "scan_regions",
+		Help:      "Number of regions in the last scan.",
+	})
+	collectionFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "collection_failures_total",
+		Help:      "Number of collections which failed to scan the regions.",
+	})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the HTTP requests by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler", "method", "code"})
+	storageSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_size_bytes",
+		Help:      "Approximate size of the stored data on disk.",
+	}, []string{"storage"})
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "heatmap_cache_requests_total",
+		Help:      "Number of heatmap requests by whether they hit the cache.",
+	}, []string{"result"})
+
+	// the values of tables in the latest axis
+	tableMetrics = map[string]*prometheus.GaugeVec{
+		"read_bytes":    newTableGaugeVec("read_bytes", "Read bytes of the table in the latest interval."),
+		"written_bytes": newTableGaugeVec("written_bytes", "Written bytes of the table in the latest interval."),
+		"read_keys":     newTableGaugeVec("read_keys", "Read keys of the table in the latest interval."),
+		"written_keys":  newTableGaugeVec("written_keys", "Written keys of the table in the latest interval."),
+	}
+)
+
+func newTableGaugeVec(name string, help string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "table",
+		Name:      name,
+		Help:      help,
+	}, []string{"db", "table"})
+}
+
+func init() {
+	prometheus.MustRegister(scanDuration, scanRegionCount, collectionFailures, requestDuration, storageSize, cacheRequests)
+	for _, vec := range tableMetrics {
+		prometheus.MustRegister(vec)
+	}
+}
+
+// tableStat is the values of a table in an axis
+type tableStat struct {
+	db    string
+	table string
+	regionData
+}
+
+func (s *tableStat) add(data *regionData) {
+	s.ReadBytes += data.ReadBytes
+	s.WrittenBytes += data.WrittenBytes
+	s.ReadKeys += data.ReadKeys
+	s.WrittenKeys += data.WrittenKeys
+}
+
+// split returns the i-th of n equal parts of data, where the remainders are given to the first part
+func (data *regionData) split(i int, n int) *regionData {
+	part := func(v uint64) uint64 {
+		if i == 0 {
+			return v/uint64(n) + v%uint64(n)
+		}
+		return v / uint64(n)
+	}
+	return &regionData{
+		WrittenBytes: part(data.WrittenBytes),
+		ReadBytes:    part(data.ReadBytes),
+		WrittenKeys:  part(data.WrittenKeys),
+		ReadKeys:     part(data.ReadKeys),
+	}
+}
+
+// tableStats sums the values of the lines of axis by the tables they overlap, ordered by the read and written bytes
+// from the biggest. A line overlapping several tables is split equally among them.
+func tableStats(axis *DiscreteAxis, index *LabelIndex) []*tableStat {
+	stats := make(map[string]*tableStat)
+	lineStart := axis.StartKey
+	for _, line := range axis.Lines {
+		startKey := lineStart
+		lineStart = line.EndKey
+		// the data and the indices of a table are counted once
+		counted := make(map[string]bool)
+		ids := make([]string, 0, 1)
+		for _, label := range index.Query(startKey, line.EndKey, axis.EndTime, axis.EndTime) {
+			if label.Table == "" {
+				continue
+			}
+			id := label.DB + "." + label.Table
+			if counted[id] {
+				continue
+			}
+			counted[id] = true
+			ids = append(ids, id)
+			if _, ok := stats[id]; !ok {
+				stats[id] = &tableStat{db: label.DB, table: label.Table}
+			}
+		}
+		for i, id := range ids {
+			stats[id].add(line.RegionUnit.Max.split(i, len(ids)))
+		}
+	}
+	result := make([]*tableStat, 0, len(stats))
+	for _, stat := range stats {
+		result = append(result, stat)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.ReadBytes+a.WrittenBytes != b.ReadBytes+b.WrittenBytes {
+			return a.ReadBytes+a.WrittenBytes > b.ReadBytes+b.WrittenBytes
+		}
+		if a.db != b.db {
+			return a.db < b.db
+		}
+		return a.table < b.table
+	})
+	return result
+}
+
+// updateTableMetrics sets the table metrics by the latest axis. Only the hottest limit tables are exported
+// to limit the cardinality, and the others are summed up as one table.
+func updateTableMetrics(axis *DiscreteAxis, limit int) {
+	if axis == nil {
+		return
+	}
+	stats := tableStats(axis, tables.labelIndex())
+	if limit >= 0 && len(stats) > limit {
+		others := &tableStat{table: otherTables}
+		for _, stat := range stats[limit:] {
+			others.add(&stat.regionData)
+		}
+		stats = append(stats[:limit], others)
+	}
+	// the new values are set before the stale tables are deleted, so that a scrape never sees the metrics empty
+	exported := make(map[[2]string]struct{}, len(stats))
+	for _, stat := range stats {
+		exported[[2]string{stat.db, stat.table}] = struct{}{}
+		tableMetrics["read_bytes"].WithLabelValues(stat.db, stat.table).Set(float64(stat.ReadBytes))
+		tableMetrics["written_bytes"].WithLabelValues(stat.db, stat.table).Set(float64(stat.WrittenBytes))
+		tableMetrics["read_keys"].WithLabelValues(stat.db, stat.table).Set(float64(stat.ReadKeys))
+		tableMetrics["written_keys"].WithLabelValues(stat.db, stat.table).Set(float64(stat.WrittenKeys))
+	}
+	for table := range exportedTables {
+		if _, ok := exported[table]; !ok {
+			for _, vec := range tableMetrics {
+				vec.DeleteLabelValues(table[0], table[1])
+			}
+		}
+	}
+	exportedTables = exported
+}
+
+// the db and table names exported by the last updateTableMetrics, which is only called by the collector
+var exportedTables map[[2]string]struct{}
+
+// size returns the approximate size of the data on disk
+func (db *LeveldbStorage) size() int64 {
+	first, last := db.Bounds()
+	if first == nil {
+		return 0
+	}
+	sizes, err := db.SizeOf([]util.Range{{Start: first, Limit: append(last, 0)}})
+	if err != nil {
+		lerr(err)
+		return 0
+	}
+	return sizes.Sum()
+}
+
+// metricsHandler serves the metrics in the Prometheus format
+func metricsHandler() http.Handler {
+	stores := map[string]*LeveldbStorage{
+		"region":  globalRegionStore.LeveldbStorage,
+		"table":   tables.LeveldbStorage,
+		"hotspot": hotspots.LeveldbStorage,
+	}
+	metrics := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, store := range stores {
+			if store != nil {
+				storageSize.WithLabelValues(name).Set(float64(store.size()))
+			}
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
+
+// instrumentHandler observes the latency of the requests to h by the patterns of mux which they match
+func instrumentHandler(mux *http.ServeMux, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unknown"
+		}
+		observer := requestDuration.MustCurryWith(prometheus.Labels{"handler": pattern})
+		promhttp.InstrumentHandlerDuration(observer, h).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testmetricstablepath = "../test/metrics_table"
+
+func TestUpdateTableMetrics(t *testing.T) {
+	openTestTables(testmetricstablepath)
+	defer tables.LeveldbStorage.Close()
+	saveTestTables(
+		&Table{Name: "orders", DB: "sales", ID: 45, Indices: map[int64]string{1: "idx"}},
+		&Table{Name: "users", DB: "sales", ID: 46},
+		&Table{Name: "logs", DB: "ops", ID: 47},
+	)
+	axis := &DiscreteAxis{
+		EndTime: time.Now(),
+		Lines: []*Line{
+			{EndKey: GenTablePrefix(45), RegionUnit: newRegionUnit(newRegionInfo("", "", 100, 0, 100, 0))},
+			// the line covers both the index and the records, which are counted once
+			{EndKey: GenTablePrefix(46), RegionUnit: newRegionUnit(newRegionInfo("", "", 20, 2, 10, 1))},
+			// the line covers two tables, which share the values
+			{EndKey: GenTablePrefix(48), RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, 7, 2))},
+			{EndKey: "~", RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, 3, 1))},
+		},
+	}
+	stats := tableStats(axis, tables.labelIndex())
+	if len(stats) != 3 || stats[0].table != "orders" || stats[0].WrittenBytes != 20 || stats[0].ReadKeys != 1 ||
+		stats[1].table != "users" || stats[1].ReadBytes != 4 || stats[2].table != "logs" || stats[2].ReadBytes != 3 {
+		t.Fatalf("error table stats %v", stats)
+	}
+
+	updateTableMetrics(axis, 2)
+	expect := []struct {
+		metric string
+		db     string
+		table  string
+		value  float64
+	}{
+		{"written_bytes", "sales", "orders", 20},
+		{"read_bytes", "sales", "orders", 10},
+		{"written_keys", "sales", "orders", 2},
+		{"read_bytes", "sales", "users", 4},
+		{"read_bytes", "", otherTables, 3},
+		{"read_keys", "", otherTables, 1},
+	}
+	for _, e := range expect {
+		if value := testutil.ToFloat64(tableMetrics[e.metric].WithLabelValues(e.db, e.table)); value != e.value {
+			t.Fatalf("%s of %s.%s: expect %v, but got %v", e.metric, e.db, e.table, e.value, value)
+		}
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(tableMetrics["read_bytes"])
+	families, err := registry.Gather()
+	perr(err)
+	if len(families) != 1 || len(families[0].Metric) != 3 {
+		t.Fatalf("expect 3 tables, but got %v", families)
+	}
+
+	// the tables which are no longer exported are deleted
+	updateTableMetrics(axis, 1)
+	families, err = registry.Gather()
+	perr(err)
+	if len(families) != 1 || len(families[0].Metric) != 2 {
+		t.Fatalf("expect 2 tables, but got %v", families)
+	}
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/test", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	mux.Handle("/metrics", metricsHandler())
+	handler := instrumentHandler(mux, mux)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/test?x=1", nil))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, metric := range []string{
+		`keyvisual_http_request_duration_seconds_count{code="418",handler="/api/v1/test",method="get"} 1`,
+		`keyvisual_collection_failures_total 0`,
+		`keyvisual_storage_size_bytes{storage="region"}`,
+	} {
+		if !strings.Contains(body, metric) {
+			t.Fatalf("%s is not found in the metrics:\n%s", metric, body)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unix timestamps whose absolute value is not less than it are treated as milliseconds
+const unixMilliThreshold = 1e11
+
+// parseTime parses a time parameter, which can be
+// a duration relative to now (e.g. "-60m"),
+// an RFC3339 time (e.g. "2019-10-24T10:00:00+08:00"),
+// or a unix timestamp in seconds or milliseconds
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if v >= unixMilliThreshold || v <= -unixMilliThreshold {
+			return time.Unix(v/1000, v%1000*int64(time.Millisecond)), nil
+		}
+		return time.Unix(v, 0), nil
+	}
+	// the '+' of a time zone offset becomes a space if it is not escaped in the query string
+	if t, err := time.Parse(time.RFC3339, strings.Replace(s, " ", "+", -1)); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expect a duration relative to now (e.g. -60m), an RFC3339 time or a unix timestamp in seconds or milliseconds", s)
+}
+
+// parseTimeRange parses the starttime and endtime parameters, the default range is the last 60 minutes
+func parseTimeRange(start string, end string, now time.Time) (startTime time.Time, endTime time.Time, err error) {
+	endTime = now
+	if end != "" {
+		if endTime, err = parseTime(end, now); err != nil {
+			return startTime, endTime, fmt.Errorf("endtime: %s", err.Error())
+		}
+	}
+	startTime = endTime.Add(-60 * time.Minute)
+	if start != "" {
+		if startTime, err = parseTime(start, now); err != nil {
+			return startTime, endTime, fmt.Errorf("starttime: %s", err.Error())
+		}
+	}
+	if !startTime.Before(endTime) {
+		return startTime, endTime, fmt.Errorf("starttime %s is not before endtime %s", startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
+	}
+	return startTime, endTime, nil
+}
+
+// findTable finds a table by its name and optionally the database it belongs to, names are case-insensitive
+func findTable(db string, name string) (*Table, error) {
+	var found *Table
+	for _, table := range loadTables() {
+		if !strings.EqualFold(table.Name, name) || (db != "" && !strings.EqualFold(table.DB, db)) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("table %s exists in both database %s and %s, please specify db", name, found.DB, table.DB)
+		}
+		found = table
+	}
+	if found == nil {
+		if db != "" {
+			return nil, fmt.Errorf("table %s.%s not found", db, name)
+		}
+		return nil, fmt.Errorf("table %s not found", name)
+	}
+	return found, nil
+}
+
+// findTableByID finds a table by its ID
+func findTableByID(id int64) (*Table, error) {
+	for _, table := range loadTables() {
+		if table.ID == id {
+			return table, nil
+		}
+	}
+	return nil, fmt.Errorf("table %d not found", id)
+}
+
+// parseKeyRange resolves the key range of a request, which can be given by
+// the raw hex keys startkey and endkey,
+// or the selectors db, table and table_id, optionally narrowed down by partition, index or handle.
+// A partitioned table without the partition selector covers the IDs of all of its partitions, which is rejected
+// if the IDs are not contiguous, since the range would cover the tables created between the partitions.
+// The endKey of the whole key space is "~".
+func parseKeyRange(form url.Values) (startKey string, endKey string, err error) {
+	db := form.Get("db")
+	name := form.Get("table")
+	tableID := form.Get("table_id")
+	index := form.Get("index")
+	handle := form.Get("handle")
+	partition := form.Get("partition")
+	if db == "" && name == "" && tableID == "" && partition == "" && index == "" && handle == "" {
+		startKey = form.Get("startkey")
+		endKey = form.Get("endkey")
+		if endKey == "" {
+			endKey = "~" // \126, which is the biggest displayable character
+		}
+		return startKey, endKey, nil
+	}
+	if form.Get("startkey") != "" || form.Get("endkey") != "" {
+		return "", "", errors.New("startkey and endkey cannot be used together with table selectors")
+	}
+
+	var table *Table
+	switch {
+	case tableID != "":
+		if name != "" || db != "" {
+			return "", "", errors.New("table_id cannot be used together with db or table")
+		}
+		id, err := strconv.ParseInt(tableID, 10, 64)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid table_id %q", tableID)
+		}
+		if table, err = findTableByID(id); err != nil {
+			// an ID unknown to the schema, e.g. the physical ID of a partition, covers the ID itself
+			if index != "" || partition != "" {
+				return "", "", err
+			}
+			table = &Table{ID: id}
+		}
+	case name != "":
+		if table, err = findTable(db, name); err != nil {
+			return "", "", err
+		}
+	default:
+		return "", "", errors.New("table or table_id is required")
+	}
+
+	// the data of a partitioned table is stored under the physical IDs of its partitions
+	physicals := table.physicalTables()
+	if partition != "" {
+		physicals = nil
+		for id, partitionName := range table.Partitions {
+			if strings.EqualFold(partitionName, partition) {
+				physicals = []physicalTable{{id, partitionName}}
+			}
+		}
+		if physicals == nil {
+			return "", "", fmt.Errorf("partition %s not found in table %s.%s", partition, table.DB, table.Name)
+		}
+	}
+	first, last := physicals[0].ID, physicals[len(physicals)-1].ID
+
+	switch {
+	case index != "" && handle != "":
+		return "", "", errors.New("index and handle cannot be used together")
+	case (index != "" || handle != "") && first != last:
+		return "", "", fmt.Errorf("partition is required for an index or a handle of the partitioned table %s.%s", table.DB, table.Name)
+	case index != "":
+		// the primary key of a clustered table is stored as the record keys
+		if table.IsCommonHandle && strings.EqualFold(index, "primary") {
+			return GenTableRecordPrefix(first), GenTablePrefix(first + 1), nil
+		}
+		for id, indexName := range table.Indices {
+			if strings.EqualFold(indexName, index) {
+				return GenTableIndexPrefix(first, id), GenTableIndexPrefix(first, id+1), nil
+			}
+		}
+		return "", "", fmt.Errorf("index %s not found in table %s.%s", index, table.DB, table.Name)
+	case handle != "":
+		// the record keys of a clustered table are encoded by the primary key, which has no int handle
+		if table.IsCommonHandle {
+			return "", "", fmt.Errorf("handle cannot be used for the clustered table %s.%s", table.DB, table.Name)
+		}
+		h, err := strconv.ParseInt(handle, 10, 64)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid handle %q", handle)
+		}
+		if h == math.MaxInt64 {
+			return GenTableRowKey(first, h), GenTablePrefix(first + 1), nil
+		}
+		return GenTableRowKey(first, h), GenTableRowKey(first, h+1), nil
+	default:
+		for i := 1; i < len(physicals); i++ {
+			if physicals[i].ID != physicals[i-1].ID+1 {
+				return "", "", fmt.Errorf("the partitions of table %s.%s are not contiguous, please specify partition", table.DB, table.Name)
+			}
+		}
+		return GenTablePrefix(first), GenTablePrefix(last + 1), nil
+	}
+}
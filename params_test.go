@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Unix(1571900000, 0)
+	cases := []struct {
+		input  string
+		expect time.Time
+	}{
+		{"-60m", now.Add(-time.Hour)},
+		{"0m", now},
+		{"1571896400", time.Unix(1571896400, 0)},
+		{"1571896400123", time.Unix(1571896400, 123*int64(time.Millisecond))},
+		{"2019-10-24T05:53:20Z", time.Unix(1571896400, 0)},
+		{"2019-10-24T13:53:20+08:00", time.Unix(1571896400, 0)},
+		// an unescaped '+' in the query string
+		{"2019-10-24T13:53:20 08:00", time.Unix(1571896400, 0)},
+	}
+	for _, c := range cases {
+		result, err := parseTime(c.input, now)
+		if err != nil {
+			t.Fatalf("parse %s: %s", c.input, err.Error())
+		}
+		if !result.Equal(c.expect) {
+			t.Fatalf("parse %s: expect %v, but got %v", c.input, c.expect, result)
+		}
+	}
+	for _, input := range []string{"yesterday", "60x", "2019-10-24"} {
+		if _, err := parseTime(input, now); err == nil {
+			t.Fatalf("parse %s: expect error but get none", input)
+		}
+	}
+}
+
+func TestParseTimeRange(t *testing.T) {
+	now := time.Unix(1571900000, 0)
+	startTime, endTime, err := parseTimeRange("", "", now)
+	if err != nil || !endTime.Equal(now) || !startTime.Equal(now.Add(-time.Hour)) {
+		t.Fatalf("error default range %v - %v, %v", startTime, endTime, err)
+	}
+	startTime, endTime, err = parseTimeRange("", "1571896400", now)
+	if err != nil || !startTime.Equal(time.Unix(1571896400-3600, 0)) {
+		t.Fatalf("error range %v - %v, %v", startTime, endTime, err)
+	}
+	if _, _, err = parseTimeRange("-10m", "-20m", now); err == nil {
+		t.Fatalf("expect error when starttime is after endtime")
+	}
+	if _, _, err = parseTimeRange("abc", "", now); err == nil {
+		t.Fatalf("expect error when starttime is invalid")
+	}
+}
+
+const testparamstablepath = "../test/params_table"
+
+// openTestTables replaces the storage of the tables with the one at path
+func openTestTables(path string) {
+	storage, err := NewLeveldbStorage(path)
+	perr(err)
+	tables.open(storage)
+}
+
+// saveTestTables saves the tables as the versions in effect since the beginning, and rebuilds the index
+func saveTestTables(tableSlice ...*Table) {
+	tables.Lock()
+	defer tables.Unlock()
+	for _, table := range tableSlice {
+		value, err := json.Marshal(table)
+		perr(err)
+		var key = make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(table.ID))
+		perr(tables.Save(key, value))
+	}
+	tables.refreshIndex()
+}
+
+func TestParseKeyRange(t *testing.T) {
+	openTestTables(testparamstablepath)
+	defer tables.LeveldbStorage.Close()
+	saveTestTables(
+		&Table{Name: "orders", DB: "sales", ID: 45, Indices: map[int64]string{1: "idx_created_at"}},
+		&Table{Name: "orders", DB: "archive", ID: 46, Indices: map[int64]string{}},
+		&Table{Name: "users", DB: "sales", ID: 47, Indices: map[int64]string{}},
+		&Table{Name: "clustered", DB: "sales", ID: 48, Indices: map[int64]string{}, IsCommonHandle: true},
+		&Table{Name: "events", DB: "sales", ID: 50, Indices: map[int64]string{1: "idx_time"},
+			Partitions: map[int64]string{51: "p0", 52: "p1", 53: "p2"}},
+		// a partition added after the table 60 is created
+		&Table{Name: "metrics", DB: "sales", ID: 58, Indices: map[int64]string{},
+			Partitions: map[int64]string{59: "p0", 61: "p1"}},
+		&Table{Name: "between", DB: "sales", ID: 60, Indices: map[int64]string{}},
+	)
+
+	cases := []struct {
+		query      string
+		expectFrom string
+		expectTo   string
+	}{
+		{"", "", "~"},
+		{"startkey=7480&endkey=7481", "7480", "7481"},
+		{"table_id=45", GenTablePrefix(45), GenTablePrefix(46)},
+		{"db=sales&table=orders", GenTablePrefix(45), GenTablePrefix(46)},
+		{"table=USERS", GenTablePrefix(47), GenTablePrefix(48)},
+		{"db=sales&table=orders&index=idx_created_at", GenTableIndexPrefix(45, 1), GenTableIndexPrefix(45, 2)},
+		{"table_id=45&index=idx_created_at", GenTableIndexPrefix(45, 1), GenTableIndexPrefix(45, 2)},
+		{"table_id=45&handle=100", GenTableRowKey(45, 100), GenTableRowKey(45, 101)},
+		{"table=clustered&index=PRIMARY", GenTableRecordPrefix(48), GenTablePrefix(49)},
+		// the logical ID of a partitioned table holds no data
+		{"table=events", GenTablePrefix(51), GenTablePrefix(54)},
+		{"table_id=50", GenTablePrefix(51), GenTablePrefix(54)},
+		{"table=events&partition=P1", GenTablePrefix(52), GenTablePrefix(53)},
+		{"table=events&partition=p2&index=idx_time", GenTableIndexPrefix(53, 1), GenTableIndexPrefix(53, 2)},
+		{"table=events&partition=p0&handle=7", GenTableRowKey(51, 7), GenTableRowKey(51, 8)},
+		{"table_id=52", GenTablePrefix(52), GenTablePrefix(53)},
+		{"table=metrics&partition=p1", GenTablePrefix(61), GenTablePrefix(62)},
+	}
+	for _, c := range cases {
+		form, _ := url.ParseQuery(c.query)
+		startKey, endKey, err := parseKeyRange(form)
+		if err != nil {
+			t.Fatalf("%s: %s", c.query, err.Error())
+		}
+		if startKey != c.expectFrom || endKey != c.expectTo {
+			t.Fatalf("%s: expect [%s, %s), but got [%s, %s)", c.query, c.expectFrom, c.expectTo, startKey, endKey)
+		}
+	}
+
+	for _, query := range []string{
+		"table=orders",
+		"table=missing",
+		"db=sales",
+		"table_id=abc",
+		"table_id=45&table=orders",
+		"table=users&index=missing",
+		"table=users&index=a&handle=1",
+		"table=users&startkey=7480",
+		"table=events&partition=p9",
+		"table=events&index=idx_time",
+		"table=events&handle=1",
+		"partition=p0",
+		// the range of all partitions would cover the table between them
+		"table=metrics",
+		"table=clustered&handle=1",
+	} {
+		form, _ := url.ParseQuery(query)
+		if _, _, err := parseKeyRange(form); err == nil {
+			t.Fatalf("%s: expect error but get none", query)
+		}
+	}
+}
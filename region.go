@@ -1,16 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/HunDunDM/key-visual/matrix"
 	"sync"
 	"time"
 )
 
-const defaultRegionPath = "../storage/region"
-
 type regionInfo struct {
 	ID           uint64 `json:"id"`
 	StartKey     string `json:"start_key"`
@@ -21,12 +22,15 @@ type regionInfo struct {
 	ReadKeys     uint64 `json:"read_keys,omitempty"`
 }
 
-func ScanRegions() []*regionInfo {
+// ScanRegions gets all the regions from PD, an error is returned if any request fails or ctx is canceled
+func ScanRegions(ctx context.Context) ([]*regionInfo, error) {
 	var key []byte
-	var err error
 	regions := make([]*regionInfo, 0, 1024)
 	for {
-		info := regionRequest(key, 1024)
+		info, err := regionRequest(ctx, key, 1024)
+		if err != nil {
+			return nil, err
+		}
 		length := len(info.Regions)
 		if length == 0 {
 			break
@@ -38,9 +42,11 @@ func ScanRegions() []*regionInfo {
 			break
 		}
 		key, err = hex.DecodeString(lastEndKey)
-		perr(err)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return regions
+	return regions, nil
 }
 
 type regionData struct {
@@ -148,10 +154,26 @@ func (axis *DiscreteAxis) DeNoise(threshold uint64) {
 	axis.Lines = newAxis
 }
 
-// convert the regionInfo into key axis and insert it into Stat
-func (r *RegionStore) Append(regions []*regionInfo) {
+// toMatrix converts the axis into the one of the matrix package, whose values are given by separateValue
+func (axis *DiscreteAxis) toMatrix(separateValue func(r *regionUnit) matrix.Value) *matrix.DiscreteAxis {
+	lines := make([]*matrix.Line, len(axis.Lines))
+	for i, v := range axis.Lines {
+		lines[i] = &matrix.Line{
+			EndKey: v.EndKey,
+			Value:  separateValue(v.RegionUnit),
+		}
+	}
+	return &matrix.DiscreteAxis{
+		StartKey: axis.StartKey,
+		Lines:    lines,
+		EndTime:  axis.EndTime,
+	}
+}
+
+// convert the regionInfo into key axis and insert it into Stat, the stored axis is returned
+func (r *RegionStore) Append(regions []*regionInfo) *DiscreteAxis {
 	if len(regions) == 0 {
-		return
+		return nil
 	}
 	if regions[len(regions)-1].EndKey == "" {
 		regions[len(regions)-1].EndKey = "~"
@@ -166,7 +188,7 @@ func (r *RegionStore) Append(regions []*regionInfo) {
 		}
 	}
 	if firstIndex == len(regions) {
-		return
+		return nil
 	}
 	// generate DiscreteAxis firstly
 	axis := &DiscreteAxis{
@@ -189,12 +211,11 @@ func (r *RegionStore) Append(regions []*regionInfo) {
 
 	value, err := json.Marshal(axis)
 	perr(err)
-	nowTime := make([]byte, 8)
-	binary.BigEndian.PutUint64(nowTime, uint64(time.Now().Unix()))
 	r.Lock()
 	defer r.Unlock()
-	err = r.Save(nowTime, value)
+	err = r.Save(timeKey(time.Now()), value)
 	perr(err)
+	return axis
 }
 
 func (r *RegionStore) Range(startTime time.Time, endTime time.Time, separateValue func(r *regionUnit) matrix.Value) *matrix.DiscretePlane {
@@ -217,40 +238,51 @@ func (r *RegionStore) Range(startTime time.Time, endTime time.Time, separateValu
 		axis := DiscreteAxis{}
 		err := json.Unmarshal([]byte(value), &axis)
 		perr(err)
-
-		lines := make([]*matrix.Line, len(axis.Lines))
-		for i, v := range axis.Lines {
-			lines[i] = &matrix.Line{
-				EndKey: v.EndKey,
-				Value:  separateValue(v.RegionUnit),
-			}
-		}
-		newAxis := matrix.DiscreteAxis{
-			StartKey: axis.StartKey,
-			Lines:    lines,
-			EndTime:  axis.EndTime,
-		}
-		rangeTimePlane.Axes = append(rangeTimePlane.Axes, &newAxis)
+		rangeTimePlane.Axes = append(rangeTimePlane.Axes, axis.toMatrix(separateValue))
 	}
 	rangeTimePlane.StartTime = rangeTimePlane.Axes[0].EndTime.Add(-*interval)
 	return &rangeTimePlane
 }
 
+// TimeRange returns the time of the earliest and the latest stored axis
+// ok is false when no axis has been stored yet
+func (r *RegionStore) TimeRange() (earliest time.Time, latest time.Time, ok bool) {
+	r.RLock()
+	first, last := r.Bounds()
+	r.RUnlock()
+	if len(first) != 8 || len(last) != 8 {
+		return earliest, latest, false
+	}
+	earliest = time.Unix(int64(binary.BigEndian.Uint64(first)), 0)
+	latest = time.Unix(int64(binary.BigEndian.Uint64(last)), 0)
+	return earliest, latest, true
+}
+
+// DeleteBefore deletes the axes stored before t, and returns the amount of deleted axes
+func (r *RegionStore) DeleteBefore(t time.Time) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.DeleteRange(nil, timeKey(t))
+}
+
+// CheckRange returns an error if there is no axis stored in [startTime, endTime]
+func (r *RegionStore) CheckRange(startTime time.Time, endTime time.Time) error {
+	earliest, latest, ok := r.TimeRange()
+	if !ok {
+		return errors.New("no data has been stored yet")
+	}
+	// the earliest axis covers the interval before its own time
+	if startTime.After(latest) || endTime.Before(earliest.Add(-*interval)) {
+		return fmt.Errorf("no data between %s and %s, the stored history is from %s to %s",
+			startTime.Format(time.RFC3339), endTime.Format(time.RFC3339),
+			earliest.Add(-*interval).Format(time.RFC3339), latest.Format(time.RFC3339))
+	}
+	return nil
+}
+
 type RegionStore struct {
 	sync.RWMutex
 	*LeveldbStorage
 }
 
 var globalRegionStore RegionStore
-
-func init() {
-	globalRegionStore.LeveldbStorage, _ = NewLeveldbStorage(defaultRegionPath)
-	regions := []*regionInfo{
-		{
-			StartKey: "",
-			EndKey:   "~",
-		},
-	}
-	// insert an empty axis, which means that from the last time the server shutdown till now the data is zero
-	globalRegionStore.Append(regions)
-}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"reflect"
@@ -15,6 +16,7 @@ import (
 
 const teststatpath = "../test/stat"
 const testrangepath = "../test/range"
+const testcheckrangepath = "../test/checkrange"
 
 func encodeTablePrefix(tableID int64) string {
 	key := tablecodec.EncodeTablePrefix(tableID)
@@ -104,8 +106,10 @@ func TestRegionStore_Range(t *testing.T) {
 }
 
 func TestScanRegions(t *testing.T) {
-	regions := ScanRegions()
-	newRegions := ScanRegions()
+	regions, err := ScanRegions(context.Background())
+	perr(err)
+	newRegions, err := ScanRegions(context.Background())
+	perr(err)
 	if regions == nil || len(regions) == 0 || newRegions == nil || len(newRegions) == 0 {
 		t.Fatalf("error scan regions")
 	}
@@ -200,3 +204,18 @@ func TestDiscreteAxis_DeNoise(t *testing.T) {
 		t.Fatalf("error denoise")
 	}
 }
+
+func TestRegionStore_CheckRange(t *testing.T) {
+	globalRegionStore.LeveldbStorage, _ = NewLeveldbStorage(testcheckrangepath)
+	defer globalRegionStore.LeveldbStorage.Close()
+	globalRegionStore.Append([]*regionInfo{
+		newRegionInfo("a", "b", 1, 2, 3, 4),
+	})
+	now := time.Now()
+	if err := globalRegionStore.CheckRange(now.Add(-time.Hour), now.Add(time.Second)); err != nil {
+		t.Fatalf("expect no error but get %s", err.Error())
+	}
+	if err := globalRegionStore.CheckRange(now.Add(time.Hour), now.Add(2*time.Hour)); err == nil {
+		t.Fatalf("expect error when the range is after the stored history")
+	}
+}
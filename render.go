@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	scaleLinear = "linear"
+	scaleLog    = "log"
+	scaleSqrt   = "sqrt"
+
+	// the size of an image if it is not given
+	defaultRenderWidth  = 960
+	defaultRenderHeight = 540
+	minRenderSize       = 200
+	maxRenderSize       = 4096
+
+	// the width and height of a character of basicfont.Face7x13
+	charWidth  = 7
+	charHeight = 13
+
+	renderMargin = 8
+	labelWidth   = 160
+	legendWidth  = 72
+	timeAxisSize = 20
+)
+
+// the same colors as the web page, from the smallest value to the biggest one
+var heatmapColors = []struct {
+	value float64
+	color color.RGBA
+}{
+	{0, color.RGBA{0, 0, 0, 255}},
+	{0.4, color.RGBA{63, 4, 115, 255}},
+	{0.6, color.RGBA{114, 8, 123, 255}},
+	{0.75, color.RGBA{177, 13, 86, 255}},
+	{0.85, color.RGBA{253, 200, 53, 255}},
+	{0.9, color.RGBA{254, 255, 63, 255}},
+	{1, color.RGBA{254, 255, 176, 255}},
+}
+
+var labelColors = []color.RGBA{
+	{0x98, 0xdf, 0x8a, 255},
+	{0x2c, 0xa0, 0x2c, 255},
+	{0x1f, 0x77, 0xb4, 255},
+	{0x17, 0xbe, 0xcf, 255},
+}
+
+var (
+	backgroundColor = color.RGBA{255, 255, 255, 255}
+	textColor       = color.RGBA{0, 0, 0, 255}
+)
+
+// renderOptions are the options of rendering a heatmap into an image
+type renderOptions struct {
+	Scale  string // "linear", "log" or "sqrt"
+	Width  int
+	Height int
+	Legend bool
+}
+
+// parseRenderOptions parses the options from the form of a request
+func parseRenderOptions(r *http.Request) (*renderOptions, error) {
+	opts := &renderOptions{
+		Scale:  r.FormValue("scale"),
+		Width:  defaultRenderWidth,
+		Height: defaultRenderHeight,
+		Legend: r.FormValue("legend") != "false",
+	}
+	switch opts.Scale {
+	case "":
+		opts.Scale = scaleLog
+	case scaleLinear, scaleLog, scaleSqrt:
+	default:
+		return nil, fmt.Errorf("invalid scale %q, expect %s, %s or %s", opts.Scale, scaleLinear, scaleLog, scaleSqrt)
+	}
+	for name, size := range map[string]*int{"width": &opts.Width, "height": &opts.Height} {
+		s := r.FormValue(name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil || v < minRenderSize || v > maxRenderSize {
+			return nil, fmt.Errorf("invalid %s %q, expect an integer in [%d, %d]", name, s, minRenderSize, maxRenderSize)
+		}
+		*size = v
+	}
+	return opts, nil
+}
+
+// scaleValue maps a value in [0, max] into [0, 1]
+func scaleValue(scale string, value float64, max float64) float64 {
+	if max <= 0 {
+		return 0
+	}
+	switch scale {
+	case scaleLinear:
+		return value / max
+	case scaleSqrt:
+		return math.Sqrt(value) / math.Sqrt(max)
+	default:
+		return math.Log1p(value) / math.Log1p(max)
+	}
+}
+
+// unscaleValue is the inverse of scaleValue
+func unscaleValue(scale string, ratio float64, max float64) float64 {
+	switch scale {
+	case scaleLinear:
+		return ratio * max
+	case scaleSqrt:
+		return ratio * ratio * max
+	default:
+		return math.Expm1(ratio * math.Log1p(max))
+	}
+}
+
+// colorOf returns the color of a value scaled into [0, 1]
+func colorOf(ratio float64) color.RGBA {
+	i := 1
+	for ; i < len(heatmapColors)-1 && heatmapColors[i].value < ratio; i++ {
+	}
+	lo, hi := heatmapColors[i-1], heatmapColors[i]
+	m := (ratio - lo.value) / (hi.value - lo.value)
+	m = math.Max(0, math.Min(1, m))
+	mix := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a)*(1-m) + float64(b)*m))
+	}
+	return color.RGBA{mix(lo.color.R, hi.color.R), mix(lo.color.G, hi.color.G), mix(lo.color.B, hi.color.B), 255}
+}
+
+// formatValue formats a value shortly, e.g. 1.5K or 12M
+func formatValue(value float64) string {
+	units := []string{"", "K", "M", "G", "T", "P"}
+	i := 0
+	for ; i < len(units)-1 && value >= 1000; i++ {
+		value /= 1000
+	}
+	if i == 0 || value >= 100 {
+		return fmt.Sprintf("%.0f%s", value, units[i])
+	}
+	return fmt.Sprintf("%.3g%s", value, units[i])
+}
+
+// heatmapValue returns the value of a cell, the data of a heatmap rendered into an image should be generated by a tag
+func heatmapValue(v interface{}) float64 {
+	if value, ok := v.(uint64); ok {
+		return float64(value)
+	}
+	return 0
+}
+
+// canvas is where a heatmap is drawn
+type canvas interface {
+	rect(x, y, w, h int, c color.RGBA)
+	// text draws s with its top left corner at (x, y)
+	text(x, y int, s string, c color.RGBA)
+}
+
+// drawHeatmap draws the cells, the labels, the time axis and the legend of hmap
+func drawHeatmap(c canvas, hmap *Heatmap, opts *renderOptions) {
+	c.rect(0, 0, opts.Width, opts.Height, backgroundColor)
+	times, keys := len(hmap.Data), 0
+	if times > 0 {
+		keys = len(hmap.Data[0])
+	}
+	left, right := renderMargin, opts.Width-renderMargin
+	if len(hmap.LabelTree) > 0 {
+		left += labelWidth
+	}
+	if opts.Legend {
+		right -= legendWidth
+	}
+	top, bottom := renderMargin, opts.Height-renderMargin-timeAxisSize
+	if times == 0 || keys == 0 || right <= left || bottom <= top {
+		return
+	}
+	xOf := func(i int) int { return left + (right-left)*i/times }
+	yOf := func(j int) int { return top + (bottom-top)*j/keys }
+
+	max := 0.0
+	for _, axis := range hmap.Data {
+		for _, v := range axis {
+			max = math.Max(max, heatmapValue(v))
+		}
+	}
+	for i, axis := range hmap.Data {
+		for j, v := range axis {
+			ratio := scaleValue(opts.Scale, heatmapValue(v), max)
+			c.rect(xOf(i), yOf(j), xOf(i+1)-xOf(i), yOf(j+1)-yOf(j), colorOf(ratio))
+		}
+	}
+
+	// labels of tables and label rules
+	k := 0
+	drawLabel := func(node *LabelNode, name string) {
+		y, h := yOf(node.StartRow), yOf(node.EndRow)-yOf(node.StartRow)
+		c.rect(renderMargin, y, labelWidth-4, h, labelColors[k%len(labelColors)])
+		k++
+		if h >= charHeight {
+			c.text(renderMargin+2, y+(h-charHeight)/2, truncateText(name, (labelWidth-8)/charWidth), textColor)
+		}
+	}
+	for _, root := range hmap.LabelTree {
+		if root.Kind != labelNodeDB {
+			drawLabel(root, root.Name)
+			continue
+		}
+		for _, table := range root.Children {
+			drawLabel(table, root.Name+"."+table.Name)
+		}
+	}
+
+	// time axis, with about one tick per 120 pixels
+	layout := "15:04"
+	if hmap.Times[len(hmap.Times)-1].Sub(hmap.Times[0]).Hours() >= 24 {
+		layout = "01-02 15:04"
+	}
+	step := times * 120 / (right - left)
+	if step < 1 {
+		step = 1
+	}
+	for i := 0; i < len(hmap.Times); i += step {
+		x := xOf(i)
+		c.rect(x, bottom, 1, 4, textColor)
+		s := hmap.Times[i].Format(layout)
+		if x+len(s)*charWidth <= opts.Width {
+			c.text(x, bottom+5, s, textColor)
+		}
+	}
+
+	// legend, with the biggest value at the top
+	if opts.Legend {
+		x, h := right+8, bottom-top
+		for y := 0; y < h; y++ {
+			c.rect(x, top+y, 16, 1, colorOf(1-float64(y)/float64(h)))
+		}
+		for _, ratio := range []float64{1, 0.5, 0} {
+			y := top + int(float64(h)*(1-ratio)) - charHeight/2
+			y = int(math.Max(float64(top), math.Min(float64(bottom-charHeight), float64(y))))
+			c.text(x+20, y, formatValue(unscaleValue(opts.Scale, ratio, max)), textColor)
+		}
+	}
+}
+
+// truncateText cuts s into at most n characters, the basic font has ASCII characters only
+func truncateText(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	if n <= 1 {
+		return string(runes[:n])
+	}
+	return string(runes[:n-1]) + "~"
+}
+
+type pngCanvas struct {
+	img *image.RGBA
+}
+
+func (c *pngCanvas) rect(x, y, w, h int, col color.RGBA) {
+	draw.Draw(c.img, image.Rect(x, y, x+w, y+h), image.NewUniform(col), image.Point{}, draw.Src)
+}
+
+func (c *pngCanvas) text(x, y int, s string, col color.RGBA) {
+	d := &font.Drawer{
+		Dst:  c.img,
+		Src:  image.NewUniform(col),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y+basicfont.Face7x13.Ascent),
+	}
+	d.DrawString(s)
+}
+
+type svgCanvas struct {
+	buf bytes.Buffer
+}
+
+func (c *svgCanvas) rect(x, y, w, h int, col color.RGBA) {
+	fmt.Fprintf(&c.buf, `<rect x="%d" y="%d" width="%d" height="%d" fill="rgb(%d,%d,%d)"/>`+"\n", x, y, w, h, col.R, col.G, col.B)
+}
+
+func (c *svgCanvas) text(x, y int, s string, col color.RGBA) {
+	fmt.Fprintf(&c.buf, `<text x="%d" y="%d" fill="rgb(%d,%d,%d)">`, x, y+basicfont.Face7x13.Ascent, col.R, col.G, col.B)
+	_ = xml.EscapeText(&c.buf, []byte(s))
+	c.buf.WriteString("</text>\n")
+}
+
+// renderPNG renders hmap into a PNG image
+func renderPNG(w io.Writer, hmap *Heatmap, opts *renderOptions) error {
+	c := &pngCanvas{img: image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))}
+	drawHeatmap(c, hmap, opts)
+	return png.Encode(w, c.img)
+}
+
+// renderSVG renders hmap into an SVG image
+func renderSVG(w io.Writer, hmap *Heatmap, opts *renderOptions) error {
+	c := &svgCanvas{}
+	fmt.Fprintf(&c.buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="monospace" font-size="12">`+"\n", opts.Width, opts.Height)
+	drawHeatmap(c, hmap, opts)
+	c.buf.WriteString("</svg>\n")
+	_, err := c.buf.WriteTo(w)
+	return err
+}
+
+// renderHandler returns the handler of a heatmap rendered by render into contentType.
+// The load of reading and writing bytes is rendered if no tag is given.
+func renderHandler(contentType string, render func(io.Writer, *Heatmap, *renderOptions) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parseRenderOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tag := r.FormValue("tag"); tag != "" && !isHeatmapTag(tag) {
+			http.Error(w, fmt.Sprintf("invalid tag %q", tag), http.StatusBadRequest)
+			return
+		}
+		hmap, ok := requestHeatmap(w, r, "read_and_written_bytes")
+		if !ok {
+			return
+		}
+		if hmap == nil {
+			http.Error(w, "no data in the given range", http.StatusNotFound)
+			return
+		}
+		var buf bytes.Buffer
+		if err := render(&buf, hmap, opts); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-type", contentType)
+		_, err = buf.WriteTo(w)
+		lerr(err)
+	}
+}
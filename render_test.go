@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScaleValue(t *testing.T) {
+	for _, scale := range []string{scaleLinear, scaleLog, scaleSqrt} {
+		if ratio := scaleValue(scale, 0, 1000); ratio != 0 {
+			t.Fatalf("%s: expect 0, but got %v", scale, ratio)
+		}
+		if ratio := scaleValue(scale, 1000, 1000); ratio != 1 {
+			t.Fatalf("%s: expect 1, but got %v", scale, ratio)
+		}
+		ratio := scaleValue(scale, 250, 1000)
+		if value := unscaleValue(scale, ratio, 1000); math.Abs(value-250) > 1e-6 {
+			t.Fatalf("%s: expect 250, but got %v", scale, value)
+		}
+	}
+	if ratio := scaleValue(scaleLog, 10, 0); ratio != 0 {
+		t.Fatalf("expect 0 without data, but got %v", ratio)
+	}
+}
+
+func TestColorOf(t *testing.T) {
+	if c := colorOf(0); c != heatmapColors[0].color {
+		t.Fatalf("expect %v, but got %v", heatmapColors[0].color, c)
+	}
+	if c := colorOf(1); c != heatmapColors[len(heatmapColors)-1].color {
+		t.Fatalf("expect %v, but got %v", heatmapColors[len(heatmapColors)-1].color, c)
+	}
+	if c := colorOf(0.2); c.R != 32 || c.G != 2 || c.B != 58 {
+		t.Fatalf("error color %v", c)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	cases := map[float64]string{
+		0:       "0",
+		999:     "999",
+		1500:    "1.5K",
+		123456:  "123K",
+		2.5e9:   "2.5G",
+		1.25e20: "125000P",
+	}
+	for value, expect := range cases {
+		if s := formatValue(value); s != expect {
+			t.Fatalf("formatValue %v: expect %s, but got %s", value, expect, s)
+		}
+	}
+}
+
+func TestParseRenderOptions(t *testing.T) {
+	opts, err := parseRenderOptions(httptest.NewRequest("GET", "/heatmaps.png?width=400&legend=false", nil))
+	perr(err)
+	if opts.Scale != scaleLog || opts.Width != 400 || opts.Height != defaultRenderHeight || opts.Legend {
+		t.Fatalf("error options %v", opts)
+	}
+	for _, query := range []string{"scale=cubic", "width=10", "height=abc"} {
+		if _, err := parseRenderOptions(httptest.NewRequest("GET", "/heatmaps.png?"+query, nil)); err == nil {
+			t.Fatalf("expect error for %s", query)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	now := time.Unix(1574000000, 0)
+	hmap := &Heatmap{
+		Data:  [][]interface{}{{uint64(0), uint64(10)}, {uint64(100), uint64(1000)}},
+		Keys:  []string{"", GenTableRecordPrefix(45), "~"},
+		Times: []time.Time{now, now.Add(time.Minute), now.Add(2 * time.Minute)},
+		LabelTree: []*LabelNode{
+			{Kind: labelNodeDB, Name: "sales", StartRow: 1, EndRow: 2, Children: []*LabelNode{
+				{Kind: labelNodeTable, Name: "orders", StartRow: 1, EndRow: 2},
+			}},
+		},
+	}
+	opts := &renderOptions{Scale: scaleLinear, Width: 400, Height: 300, Legend: true}
+
+	var buf bytes.Buffer
+	perr(renderPNG(&buf, hmap, opts))
+	img, err := png.Decode(&buf)
+	perr(err)
+	if size := img.Bounds().Size(); size.X != 400 || size.Y != 300 {
+		t.Fatalf("expect 400x300, but got %v", size)
+	}
+
+	buf.Reset()
+	perr(renderSVG(&buf, hmap, opts))
+	svg := buf.String()
+	for _, s := range []string{`width="400"`, ">sales.orders</text>", ">1K</text>", "</svg>"} {
+		if !strings.Contains(svg, s) {
+			t.Fatalf("expect %s in the svg", s)
+		}
+	}
+}
+
+const testrenderpath = "../test/render"
+
+func TestRenderHandler(t *testing.T) {
+	globalRegionStore.LeveldbStorage, _ = NewLeveldbStorage(testrenderpath)
+	defer globalRegionStore.LeveldbStorage.Close()
+	globalRegionStore.Append([]*regionInfo{
+		newRegionInfo("a", "b", 1, 2, 3, 4),
+	})
+
+	handler := renderHandler("image/png", renderPNG)
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/heatmaps.png?tag=unknown", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expect 400 for an unknown tag, but got %d", recorder.Code)
+	}
+
+	// a failed rendering is an error of the server
+	failed := renderHandler("image/png", func(io.Writer, *Heatmap, *renderOptions) error {
+		return errors.New("render failed")
+	})
+	recorder = httptest.NewRecorder()
+	failed(recorder, httptest.NewRequest("GET", "/heatmaps.png?starttime=-10m", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("expect 500 when the rendering fails, but got %d", recorder.Code)
+	}
+}
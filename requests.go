@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 type regionsInfo struct {
@@ -32,36 +34,87 @@ type tableInfo struct {
 			O string `json:"O"`
 			L string `json:"L"`
 		} `json:"idx_name"`
+		Primary bool `json:"is_primary"`
 	} `json:"index_info"`
+	// a clustered table whose record keys are encoded by its primary key rather than an int handle
+	IsCommonHandle bool `json:"is_common_handle"`
+	Partition      *struct {
+		Definitions []struct {
+			ID   int64 `json:"id"`
+			Name struct {
+				O string `json:"O"`
+				L string `json:"L"`
+			} `json:"name"`
+		} `json:"definitions"`
+	} `json:"partition"`
 }
 
-func request(addr string, uri string, v interface{}) {
-	resp, err := http.Get(fmt.Sprintf("%s/%s", addr, uri))
-	perr(err)
+// a finished DDL job in the history of TiDB
+type ddlJobInfo struct {
+	ID         int64  `json:"id"`
+	Type       int    `json:"type"`
+	SchemaID   int64  `json:"schema_id"`
+	SchemaName string `json:"schema_name"`
+	BinlogInfo *struct {
+		SchemaVersion int64 `json:"SchemaVersion"`
+	} `json:"binlog"`
+}
+
+// the schema version after the job is done, 0 if unknown
+func (job *ddlJobInfo) schemaVersion() int64 {
+	if job.BinlogInfo == nil {
+		return 0
+	}
+	return job.BinlogInfo.SchemaVersion
+}
+
+// the client used to request PD and TiDB, so that an unavailable server cannot block the caller forever
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// request gets the json response of uri from addr into v, which is canceled with ctx
+func request(ctx context.Context, addr string, uri string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s", addr, uri), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 	r, err := ioutil.ReadAll(resp.Body)
-	perr(err)
-	err = resp.Body.Close()
-	perr(err)
-	err = json.Unmarshal(r, v)
-	perr(err)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request %s/%s: %s, %s", addr, uri, resp.Status, r)
+	}
+	return json.Unmarshal(r, v)
 }
 
-func regionRequest(key []byte, limit uint64) regionsInfo {
+func regionRequest(ctx context.Context, key []byte, limit uint64) (regionsInfo, error) {
 	uri := fmt.Sprintf("pd/api/v1/regions/key?key=%s&limit=%d", url.QueryEscape(string(key)), limit)
 	var info regionsInfo
-	request(*pdAddr, uri, &info)
-	return info
+	err := request(ctx, *pdAddr, uri, &info)
+	return info, err
 }
 
-func dbRequest(limit uint64) []*dbInfo {
+func dbRequest(ctx context.Context, limit uint64) ([]*dbInfo, error) {
 	var dbInfos = make([]*dbInfo, limit)
-	request(*tidbAddr, "schema", &dbInfos)
-	return dbInfos
+	err := getTidbPool().request(ctx, "schema", &dbInfos)
+	return dbInfos, err
 }
 
-func tableRequest(limit uint64, s string) []*tableInfo {
+func tableRequest(ctx context.Context, limit uint64, s string) ([]*tableInfo, error) {
 	var tableInfos = make([]*tableInfo, limit)
-	uri := fmt.Sprintf("schema/%s", s)
-	request(*tidbAddr, uri, &tableInfos)
-	return tableInfos
+	uri := fmt.Sprintf("schema/%s", url.PathEscape(s))
+	err := getTidbPool().request(ctx, uri, &tableInfos)
+	return tableInfos, err
+}
+
+func ddlHistoryRequest(ctx context.Context, limit uint64) ([]*ddlJobInfo, error) {
+	var jobs = make([]*ddlJobInfo, 0, limit)
+	uri := fmt.Sprintf("ddl/history?limit=%d", limit)
+	err := getTidbPool().request(ctx, uri, &jobs)
+	return jobs, err
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"testing"
 )
@@ -8,12 +9,12 @@ import (
 func TestRequests_request(t *testing.T) {
 	var infos regionsInfo
 	uri := fmt.Sprintf("pd/api/v1/regions/key?key=%s&limit=%d", "", 1024)
-	request(*pdAddr, uri, &infos)
+	request(context.Background(), *pdAddr, uri, &infos)
 	if infos.Regions == nil || len(infos.Regions) == 0 {
 		t.Fatalf("error request regionInfo")
 	}
 	var dbInfos = make([]*dbInfo, 0)
-	request(*tidbAddr, "schema", &dbInfos)
+	request(context.Background(), *tidbAddr, "schema", &dbInfos)
 	if dbInfos == nil || len(dbInfos) == 0 {
 		t.Fatalf("error request dbInfo")
 	}
@@ -23,7 +24,7 @@ func TestRequests_request(t *testing.T) {
 		}
 		var tableInfos = make([]*tableInfo, 0)
 		uri := fmt.Sprintf("schema/%s", info.Name.O)
-		request(*tidbAddr, uri, &tableInfos)
+		request(context.Background(), *tidbAddr, uri, &tableInfos)
 		if tableInfos == nil {
 			t.Fatalf("error request tableInfo")
 		}
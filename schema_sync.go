@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the amount of the latest DDL jobs to check for the changed databases,
+// if more jobs are done since the last synchronization, all databases are synchronized
+const ddlHistoryLimit = 64
+
+// schemaSyncer synchronizes the schema of TiDB into tables only when the schema version changes
+type schemaSyncer struct {
+	synced  bool  // whether the schema has been synchronized
+	version int64 // the schema version at the last synchronization
+}
+
+// sync checks the schema version of TiDB, and synchronizes the databases changed since the last synchronization
+func (s *schemaSyncer) sync(ctx context.Context) error {
+	jobs, err := ddlHistoryRequest(ctx, ddlHistoryLimit)
+	if err != nil {
+		return fmt.Errorf("check schema version: %s", err.Error())
+	}
+	var latest int64
+	for _, job := range jobs {
+		if v := job.schemaVersion(); v > latest {
+			latest = v
+		}
+	}
+	if s.synced && latest == s.version {
+		return nil
+	}
+	dbs := s.changedDBs(jobs)
+	snapshot, err := fetchTables(ctx, dbs)
+	if err != nil {
+		// the version is kept, so that the changes will be fetched again next time
+		return fmt.Errorf("synchronize schema: %s", err.Error())
+	}
+	tables.applySnapshot(snapshot, dbs, time.Now())
+	s.synced = true
+	s.version = latest
+	return nil
+}
+
+// changedDBs returns the lowercase names of databases changed since the last synchronization,
+// nil means all databases need to be synchronized
+func (s *schemaSyncer) changedDBs(jobs []*ddlJobInfo) map[string]struct{} {
+	if !s.synced {
+		return nil
+	}
+	dbs := make(map[string]struct{})
+	// whether the jobs reach the last synchronization, otherwise some jobs may be missing
+	covered := false
+	for _, job := range jobs {
+		v := job.schemaVersion()
+		if v <= s.version {
+			covered = true
+			continue
+		}
+		if job.SchemaName == "" {
+			return nil
+		}
+		dbs[strings.ToLower(job.SchemaName)] = struct{}{}
+	}
+	if !covered {
+		return nil
+	}
+	return dbs
+}
+
+// SchemaStatus reports the result of the last synchronization of the schema
+type SchemaStatus struct {
+	LastSyncTime  *time.Time `json:"last_sync_time"`       // nil if the schema has never been synchronized
+	LastError     string     `json:"last_error,omitempty"` // empty if the last synchronization succeeded
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	// the status addresses of TiDB servers whose last request failed
+	UnhealthyTiDB []string `json:"unhealthy_tidb"`
+}
+
+var (
+	schemaStatusMu sync.Mutex
+	schemaStatus   SchemaStatus
+)
+
+// recordSchemaSync records the result of a synchronization which is done at now
+func recordSchemaSync(err error, now time.Time) {
+	schemaStatusMu.Lock()
+	defer schemaStatusMu.Unlock()
+	if err != nil {
+		schemaStatus.LastError = err.Error()
+		schemaStatus.LastErrorTime = &now
+	} else {
+		schemaStatus.LastError = ""
+		schemaStatus.LastErrorTime = nil
+		schemaStatus.LastSyncTime = &now
+	}
+}
+
+// getSchemaStatus returns the status of the synchronization and the health of TiDB servers
+func getSchemaStatus() SchemaStatus {
+	schemaStatusMu.Lock()
+	status := schemaStatus
+	schemaStatusMu.Unlock()
+	status.UnhealthyTiDB = getTidbPool().unhealthyAddrs()
+	return status
+}
+
+func syncSchema(ctx context.Context) {
+	var syncer schemaSyncer
+	run := func() {
+		err := syncer.sync(ctx)
+		recordSchemaSync(err, time.Now())
+		lerr(err)
+	}
+	run()
+	ticker := time.NewTicker(*schemaInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			run()
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testschemasyncpath = "../test/schema_sync"
+
+// a stub of the status server of TiDB
+type tidbStub struct {
+	sync.Mutex
+	jobs   []map[string]interface{}
+	tables map[string][]map[string]interface{}
+	calls  map[string]int
+}
+
+func (s *tidbStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.calls[r.URL.Path]++
+	var v interface{}
+	switch {
+	case r.URL.Path == "/ddl/history":
+		v = s.jobs
+	case r.URL.Path == "/schema":
+		dbs := make([]map[string]interface{}, 0)
+		for name := range s.tables {
+			dbs = append(dbs, map[string]interface{}{
+				"db_name": map[string]string{"O": name, "L": strings.ToLower(name)},
+				"state":   5,
+			})
+		}
+		v = dbs
+	default:
+		v = s.tables[strings.TrimPrefix(r.URL.Path, "/schema/")]
+	}
+	data, _ := json.Marshal(v)
+	_, _ = w.Write(data)
+}
+
+func (s *tidbStub) addJob(version int64, db string) {
+	s.Lock()
+	defer s.Unlock()
+	s.jobs = append([]map[string]interface{}{{
+		"id":          version,
+		"schema_name": db,
+		"binlog":      map[string]int64{"SchemaVersion": version},
+	}}, s.jobs...)
+}
+
+func stubTable(id int64, name string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":   id,
+		"name": map[string]string{"O": name, "L": name},
+	}
+}
+
+func TestSchemaSyncer_sync(t *testing.T) {
+	openTestTables(testschemasyncpath)
+	defer tables.LeveldbStorage.Close()
+	iter := tables.NewIterator(nil, nil)
+	for iter.Next() {
+		perr(tables.Delete(iter.Key(), nil))
+	}
+	iter.Release()
+
+	stub := &tidbStub{
+		tables: map[string][]map[string]interface{}{
+			"sales": {stubTable(45, "orders")},
+			"logs":  {stubTable(50, "access")},
+		},
+		calls: make(map[string]int),
+	}
+	stub.addJob(10, "sales")
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	oldAddr := *tidbAddr
+	*tidbAddr = server.URL
+	defer func() { *tidbAddr = oldAddr }()
+
+	check := func(expect string) {
+		names := make([]string, 0)
+		for _, table := range loadTables() {
+			names = append(names, table.DB+"."+table.Name)
+		}
+		if fmt.Sprint(names) != expect {
+			t.Fatalf("expect %s, but got %v", expect, names)
+		}
+	}
+
+	var syncer schemaSyncer
+	// the first synchronization fetches all databases
+	if err := syncer.sync(context.Background()); err != nil {
+		t.Fatalf("expect no error but get %s", err.Error())
+	}
+	check("[logs.access sales.orders]")
+	if stub.calls["/schema/sales"] != 1 || stub.calls["/schema/logs"] != 1 {
+		t.Fatalf("expect all databases are fetched, but got %v", stub.calls)
+	}
+
+	// nothing is fetched if the schema version does not change
+	if err := syncer.sync(context.Background()); err != nil {
+		t.Fatalf("expect no error but get %s", err.Error())
+	}
+	if stub.calls["/schema"] != 1 || stub.calls["/ddl/history"] != 2 {
+		t.Fatalf("expect only the ddl history is checked, but got %v", stub.calls)
+	}
+
+	// only the changed database is fetched
+	stub.Lock()
+	stub.tables["sales"] = append(stub.tables["sales"], stubTable(46, "users"))
+	stub.Unlock()
+	stub.addJob(11, "sales")
+	if err := syncer.sync(context.Background()); err != nil {
+		t.Fatalf("expect no error but get %s", err.Error())
+	}
+	check("[logs.access sales.orders sales.users]")
+	if stub.calls["/schema/sales"] != 2 || stub.calls["/schema/logs"] != 1 {
+		t.Fatalf("expect only sales is fetched, but got %v", stub.calls)
+	}
+
+	// a dropped database
+	stub.Lock()
+	delete(stub.tables, "logs")
+	stub.Unlock()
+	stub.addJob(12, "logs")
+	if err := syncer.sync(context.Background()); err != nil {
+		t.Fatalf("expect no error but get %s", err.Error())
+	}
+	check("[sales.orders sales.users]")
+	if stub.calls["/schema/sales"] != 2 {
+		t.Fatalf("expect sales is not fetched, but got %v", stub.calls)
+	}
+
+	// a failed synchronization changes nothing, and is retried next time
+	server.Close()
+	stub.addJob(13, "sales")
+	if err := syncer.sync(context.Background()); err == nil {
+		t.Fatalf("expect error when TiDB is unavailable")
+	}
+	check("[sales.orders sales.users]")
+	if syncer.version != 12 {
+		t.Fatalf("expect version 12, but got %d", syncer.version)
+	}
+}
+
+func TestRecordSchemaSync(t *testing.T) {
+	defer func() { schemaStatus = SchemaStatus{} }()
+	now := time.Unix(1571900000, 0)
+	recordSchemaSync(nil, now)
+	recordSchemaSync(errors.New("all TiDB servers failed"), now.Add(time.Minute))
+	status := getSchemaStatus()
+	if status.LastSyncTime == nil || !status.LastSyncTime.Equal(now) || status.LastError != "all TiDB servers failed" {
+		t.Fatalf("error status %v", status)
+	}
+	// the error is cleared after a successful synchronization
+	recordSchemaSync(nil, now.Add(2*time.Minute))
+	if status = getSchemaStatus(); status.LastError != "" || status.LastErrorTime != nil {
+		t.Fatalf("error status %v", status)
+	}
+}
+
+func TestSchemaSyncer_changedDBs(t *testing.T) {
+	job := func(version int64, db string) *ddlJobInfo {
+		var job ddlJobInfo
+		data := fmt.Sprintf(`{"schema_name": "%s", "binlog": {"SchemaVersion": %d}}`, db, version)
+		perr(json.Unmarshal([]byte(data), &job))
+		return &job
+	}
+	syncer := schemaSyncer{}
+	if syncer.changedDBs([]*ddlJobInfo{job(1, "a")}) != nil {
+		t.Fatalf("expect all databases before the first synchronization")
+	}
+	syncer = schemaSyncer{synced: true, version: 10}
+	dbs := syncer.changedDBs([]*ddlJobInfo{job(12, "A"), job(11, "b"), job(10, "c")})
+	if len(dbs) != 2 {
+		t.Fatalf("expect [a b], but got %v", dbs)
+	}
+	if _, ok := dbs["a"]; !ok {
+		t.Fatalf("expect [a b], but got %v", dbs)
+	}
+	// some jobs may be missing
+	if syncer.changedDBs([]*ddlJobInfo{job(12, "a"), job(11, "b")}) != nil {
+		t.Fatalf("expect all databases when the jobs do not reach the last synchronization")
+	}
+	if syncer.changedDBs([]*ddlJobInfo{job(12, ""), job(10, "b")}) != nil {
+		t.Fatalf("expect all databases when a job does not have the database name")
+	}
+}
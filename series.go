@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the maximum amount of points of a series
+const maxSeriesPoints = 10000
+
+// SeriesPoint is the total value of the axes stored in [Time, Time + step)
+type SeriesPoint struct {
+	Time  time.Time `json:"time"`
+	Value uint64    `json:"value"`
+}
+
+// Series is the time series of a metric in a key range
+type Series struct {
+	Tag      string         `json:"tag"`
+	StartKey string         `json:"start_key"`
+	EndKey   string         `json:"end_key"`
+	Step     string         `json:"step"`
+	Points   []*SeriesPoint `json:"points"`
+}
+
+// GenerateSeries sums the values of tag in [startKey, endKey) of the axes stored in [startTime, endTime] by step.
+// Steps without stored axes have no points.
+func GenerateSeries(startTime time.Time, endTime time.Time, startKey string, endKey string, tag string, step time.Duration) *Series {
+	series := &Series{
+		Tag:      tag,
+		StartKey: startKey,
+		EndKey:   endKey,
+		Step:     step.String(),
+		Points:   make([]*SeriesPoint, 0),
+	}
+	plane := rangePlane(startTime, endTime, startKey, endKey, tag, "")
+	if plane == nil {
+		return series
+	}
+	var point *SeriesPoint
+	for _, axis := range plane.Axes {
+		// LoadRange may return an axis after endTime
+		if axis.EndTime.Before(startTime) || axis.EndTime.After(endTime) {
+			continue
+		}
+		at := startTime.Add(axis.EndTime.Sub(startTime) / step * step)
+		if point == nil || !point.Time.Equal(at) {
+			point = &SeriesPoint{Time: at}
+			series.Points = append(series.Points, point)
+		}
+		for _, line := range axis.Lines {
+			point.Value += line.Value.(*SingleUnit).Value
+		}
+	}
+	return series
+}
+
+// parseSeriesQuery parses the key range, the tag and the step of a series, where
+// the tag is read_and_written_bytes by default, and the step is the interval of collection by default
+func parseSeriesQuery(form url.Values, startTime time.Time, endTime time.Time) (startKey string, endKey string, tag string, step time.Duration, err error) {
+	if startKey, endKey, err = parseKeyRange(form); err != nil {
+		return
+	}
+	tag = form.Get("tag")
+	if tag == "" {
+		tag = "read_and_written_bytes"
+	}
+	if !isHeatmapTag(tag) {
+		err = fmt.Errorf("invalid tag %q", tag)
+		return
+	}
+	step = *interval
+	if s := form.Get("step"); s != "" {
+		if step, err = time.ParseDuration(s); err != nil || step <= 0 {
+			err = fmt.Errorf("invalid step %q", s)
+			return
+		}
+	}
+	// the values are collected once an interval
+	if step < *interval {
+		step = *interval
+	}
+	if endTime.Sub(startTime)/step >= maxSeriesPoints {
+		err = fmt.Errorf("too many points, the step should be at least %s", endTime.Sub(startTime)/maxSeriesPoints)
+	}
+	return
+}
+
+// seriesHandler returns the time series of a metric in the key range given by the same parameters as /heatmaps
+func seriesHandler(w http.ResponseWriter, r *http.Request) {
+	startTime, endTime, err := parseTimeRange(r.FormValue("starttime"), r.FormValue("endtime"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	startKey, endKey, tag, step, err := parseSeriesQuery(r.Form, startTime, endTime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := globalRegionStore.CheckRange(startTime, endTime); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, GenerateSeries(startTime, endTime, startKey, endKey, tag, step))
+}
+
+// the request of /query of Grafana's JSON datasource, whose targets are in the form of
+// the query string of /api/v1/series, e.g. "db=sales&table=orders&tag=written_bytes"
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs int64 `json:"intervalMs"`
+	Targets    []struct {
+		Target string `json:"target"`
+	} `json:"targets"`
+}
+
+// the response of /query of Grafana's JSON datasource, a datapoint is [value, unix milliseconds]
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// grafanaHandler implements Grafana's JSON datasource under prefix,
+// "/" for testing the connection, "/search" for listing targets and "/query" for getting series.
+func grafanaHandler(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, prefix) {
+		case "", "/":
+			w.WriteHeader(http.StatusOK)
+		case "/search":
+			grafanaSearch(w, r)
+		case "/query":
+			grafanaQueryHandler(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// grafanaSearch returns a target for each table, which contain the text of the search if there is one
+func grafanaSearch(w http.ResponseWriter, r *http.Request) {
+	var search struct {
+		Target string `json:"target"`
+	}
+	// the body can be empty
+	_ = json.NewDecoder(r.Body).Decode(&search)
+	targets := make([]string, 0)
+	for _, table := range loadTables() {
+		target := url.Values{"db": {table.DB}, "table": {table.Name}}.Encode()
+		if strings.Contains(target, search.Target) {
+			targets = append(targets, target)
+		}
+	}
+	writeJSON(w, targets)
+}
+
+func grafanaQueryHandler(w http.ResponseWriter, r *http.Request) {
+	var query grafanaQuery
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !query.Range.From.Before(query.Range.To) {
+		http.Error(w, "range.from should be before range.to", http.StatusBadRequest)
+		return
+	}
+	result := make([]*grafanaSeries, 0, len(query.Targets))
+	for _, target := range query.Targets {
+		form, err := url.ParseQuery(target.Target)
+		if err == nil && form.Get("step") == "" && query.IntervalMs > 0 {
+			form.Set("step", (time.Duration(query.IntervalMs) * time.Millisecond).String())
+		}
+		var startKey, endKey, tag string
+		var step time.Duration
+		if err == nil {
+			startKey, endKey, tag, step, err = parseSeriesQuery(form, query.Range.From, query.Range.To)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("target %s: %s", target.Target, err.Error()), http.StatusBadRequest)
+			return
+		}
+		series := GenerateSeries(query.Range.From, query.Range.To, startKey, endKey, tag, step)
+		datapoints := make([][2]float64, 0, len(series.Points))
+		for _, point := range series.Points {
+			datapoints = append(datapoints, [2]float64{float64(point.Value), float64(point.Time.UnixNano() / int64(time.Millisecond))})
+		}
+		result = append(result, &grafanaSeries{Target: target.Target, Datapoints: datapoints})
+	}
+	writeJSON(w, result)
+}
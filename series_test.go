@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testseriesregionpath = "../test/series_region"
+	testseriestablepath  = "../test/series_table"
+)
+
+func TestGenerateSeries(t *testing.T) {
+	globalRegionStore.LeveldbStorage, _ = NewLeveldbStorage(testseriesregionpath)
+	defer globalRegionStore.LeveldbStorage.Close()
+	openTestTables(testseriestablepath)
+	defer tables.LeveldbStorage.Close()
+	saveTestTables(&Table{Name: "orders", DB: "sales", ID: 45})
+
+	start := time.Unix(1574000000, 0)
+	for i, hot := range []uint64{10, 20, 30, 40} {
+		axis := &DiscreteAxis{
+			EndTime: start.Add(time.Duration(i) * time.Minute),
+			Lines: []*Line{
+				{EndKey: GenTablePrefix(45), RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, 1, 0))},
+				{EndKey: GenTablePrefix(46), RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, hot, 0))},
+				{EndKey: "~", RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, 5, 0))},
+			},
+		}
+		value, err := json.Marshal(axis)
+		perr(err)
+		perr(globalRegionStore.Save(timeKey(axis.EndTime), value))
+	}
+	endTime := start.Add(3 * time.Minute)
+
+	values := func(series *Series) []uint64 {
+		result := make([]uint64, 0, len(series.Points))
+		for _, point := range series.Points {
+			result = append(result, point.Value)
+		}
+		return result
+	}
+	series := GenerateSeries(start, endTime, "", "~", "read_bytes", time.Minute)
+	if !reflect.DeepEqual(values(series), []uint64{16, 26, 36, 46}) {
+		t.Fatalf("error series %v", values(series))
+	}
+	series = GenerateSeries(start, endTime, GenTablePrefix(45), GenTablePrefix(46), "read_bytes", 2*time.Minute)
+	if !reflect.DeepEqual(values(series), []uint64{30, 70}) || !series.Points[1].Time.Equal(start.Add(2*time.Minute)) {
+		t.Fatalf("error series by step %v", values(series))
+	}
+
+	recorder := httptest.NewRecorder()
+	query := "/api/v1/series?db=sales&table=orders&tag=read_bytes&starttime=1574000000&endtime=1574000180&step=2m"
+	seriesHandler(recorder, httptest.NewRequest("GET", query, nil))
+	series = &Series{}
+	perr(json.Unmarshal(recorder.Body.Bytes(), series))
+	if recorder.Code != 200 || !reflect.DeepEqual(values(series), []uint64{30, 70}) {
+		t.Fatalf("error series of a table %d %s", recorder.Code, recorder.Body)
+	}
+
+	for _, query := range []string{"tag=unknown", "step=x", "step=1s&starttime=0"} {
+		recorder := httptest.NewRecorder()
+		seriesHandler(recorder, httptest.NewRequest("GET", "/api/v1/series?"+query, nil))
+		if recorder.Code != 400 {
+			t.Fatalf("%s: expect 400, but got %d", query, recorder.Code)
+		}
+	}
+
+	// out of the stored history
+	recorder = httptest.NewRecorder()
+	seriesHandler(recorder, httptest.NewRequest("GET", "/api/v1/series?starttime=1500000000&endtime=1500000600", nil))
+	if recorder.Code != 404 {
+		t.Fatalf("expect 404 out of the history, but got %d", recorder.Code)
+	}
+
+	handler := grafanaHandler("/api/v1/grafana")
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/api/v1/grafana/search", strings.NewReader(`{"target":"orders"}`)))
+	var targets []string
+	perr(json.Unmarshal(recorder.Body.Bytes(), &targets))
+	if !reflect.DeepEqual(targets, []string{"db=sales&table=orders"}) {
+		t.Fatalf("error targets %v", targets)
+	}
+
+	body := `{"range":{"from":"2019-11-17T14:13:20Z","to":"2019-11-17T14:16:20Z"},"intervalMs":120000,
+		"targets":[{"target":"db=sales&table=orders&tag=read_bytes"}]}`
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/api/v1/grafana/query", strings.NewReader(body)))
+	var result []*grafanaSeries
+	perr(json.Unmarshal(recorder.Body.Bytes(), &result))
+	expect := [][2]float64{{30, 1574000000000}, {70, 1574000120000}}
+	if len(result) != 1 || !reflect.DeepEqual(result[0].Datapoints, expect) {
+		t.Fatalf("error grafana query %s", recorder.Body)
+	}
+
+	recorder = httptest.NewRecorder()
+	body = `{"range":{"from":"2019-11-17T14:13:20Z","to":"2019-11-17T14:16:20Z"},"targets":[{"target":"tag=unknown"}]}`
+	handler(recorder, httptest.NewRequest("POST", "/api/v1/grafana/query", strings.NewReader(body)))
+	if recorder.Code != 400 {
+		t.Fatalf("expect 400, but got %d", recorder.Code)
+	}
+}
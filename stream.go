@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HunDunDM/key-visual/matrix"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the capacity of the queue of new axes of a subscription, which is closed if the queue is full,
+	// so that a slow client cannot block the collection and catches up after reconnecting
+	streamQueueSize = 16
+	// the maximum amount of keys of the key axis of a subscription
+	maxStreamKeys = 1000
+	// the interval of the comments sent to keep an idle connection alive
+	streamKeepAlive = 30 * time.Second
+	// the delay of reconnecting suggested to the client, in milliseconds
+	streamRetry = 3000
+)
+
+// StreamColumn is a new time column of a heatmap, whose values are projected onto the key axis of the subscription
+type StreamColumn struct {
+	Time   time.Time     `json:"time"`
+	Values []interface{} `json:"values"`
+}
+
+// subscription is a client which views the heatmap of tag and mode in [startKey, endKey) on the key axis keyAxis
+type subscription struct {
+	startKey string
+	endKey   string
+	tag      string
+	mode     string
+	// the values of keyAxis are zero
+	keyAxis *matrix.DiscreteAxis
+	axes    chan *DiscreteAxis
+}
+
+func newSubscription(startKey string, endKey string, tag string, mode string, keys []string) *subscription {
+	separateValue := separateValueFunc(tag, mode)
+	keyAxis := &matrix.DiscreteAxis{StartKey: keys[0], Lines: make([]*matrix.Line, 0, len(keys)-1)}
+	for _, key := range keys[1:] {
+		keyAxis.Lines = append(keyAxis.Lines, &matrix.Line{EndKey: key, Value: separateValue(&regionUnit{})})
+	}
+	return &subscription{
+		startKey: startKey,
+		endKey:   endKey,
+		tag:      tag,
+		mode:     mode,
+		keyAxis:  keyAxis,
+		axes:     make(chan *DiscreteAxis, streamQueueSize),
+	}
+}
+
+// project returns the column of axis on the key axis of the subscription
+func (s *subscription) project(axis *DiscreteAxis) *StreamColumn {
+	dst := s.keyAxis.Clone()
+	axis.toMatrix(separateValueFunc(s.tag, s.mode)).Range(s.startKey, s.endKey).DeProjection(dst)
+	column := &StreamColumn{Time: axis.EndTime, Values: make([]interface{}, len(dst.Lines))}
+	for i, line := range dst.Lines {
+		if single, ok := line.Value.(*SingleUnit); ok {
+			column.Values[i] = single.Value
+		} else {
+			column.Values[i] = line.Value
+		}
+	}
+	return column
+}
+
+// axisHub delivers the newly stored axes to the subscriptions
+type axisHub struct {
+	sync.Mutex
+	subscriptions map[*subscription]struct{}
+}
+
+func (h *axisHub) subscribe(s *subscription) {
+	h.Lock()
+	defer h.Unlock()
+	h.subscriptions[s] = struct{}{}
+}
+
+func (h *axisHub) unsubscribe(s *subscription) {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.subscriptions[s]; ok {
+		delete(h.subscriptions, s)
+		close(s.axes)
+	}
+}
+
+// publish sends axis to every subscription without blocking, and closes the ones whose queues are full
+func (h *axisHub) publish(axis *DiscreteAxis) {
+	if axis == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	for s := range h.subscriptions {
+		select {
+		case s.axes <- axis:
+		default:
+			delete(h.subscriptions, s)
+			close(s.axes)
+		}
+	}
+}
+
+var axisStream = axisHub{subscriptions: make(map[*subscription]struct{})}
+
+// writeEvent writes v as the json data of a Server-Sent Event, id is omitted if it is zero
+func writeEvent(w io.Writer, event string, id int64, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if id != 0 {
+		_, err = fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", event, id, data)
+	} else {
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	}
+	return err
+}
+
+// parseStreamKeys parses the key axis given by keys, which are increasing and separated by comma
+func parseStreamKeys(s string) ([]string, error) {
+	keys := strings.Split(s, ",")
+	if len(keys) < 2 || len(keys) > maxStreamKeys {
+		return nil, fmt.Errorf("expect 2 to %d keys", maxStreamKeys)
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i] <= keys[i-1] {
+			return nil, errors.New("keys should be increasing")
+		}
+	}
+	return keys, nil
+}
+
+// streamHandler pushes the newly stored axes as Server-Sent Events, the key range, tag and mode are the same as /heatmaps.
+// The key axis which the axes are projected onto is given by keys, e.g. the keys of a heatmap the client is viewing.
+// Without keys, the heatmap of the time range is sent first as a "heatmap" event, and its key axis is used.
+// Each axis is sent as an "axis" event, whose id is its unix time, and the axes stored after the Last-Event-ID header
+// or the last_event_id parameter are sent first, so that a client can catch up after reconnecting.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	tag := r.FormValue("tag")
+	if tag != "" && !isHeatmapTag(tag) {
+		http.Error(w, fmt.Sprintf("invalid tag %q", tag), http.StatusBadRequest)
+		return
+	}
+	mode := r.FormValue("mode")
+	startKey, endKey, err := parseKeyRange(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var lastID int64
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.FormValue("last_event_id")
+	}
+	if lastEventID != "" {
+		if lastID, err = strconv.ParseInt(lastEventID, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid last event id %q", lastEventID), http.StatusBadRequest)
+			return
+		}
+	}
+	var keys []string
+	var snapshot *Heatmap
+	if s := r.FormValue("keys"); s != "" {
+		if keys, err = parseStreamKeys(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		startTime, endTime, err := parseTimeRange(r.FormValue("starttime"), r.FormValue("endtime"), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		snapshot = GenerateHeatmap(startTime, endTime, startKey, endKey, tag, mode)
+		keys = []string{startKey, endKey}
+		if snapshot != nil {
+			keys = snapshot.Keys
+			if lastID == 0 && len(snapshot.Times) > 0 {
+				lastID = snapshot.Times[len(snapshot.Times)-1].Unix()
+			}
+		}
+	}
+	// subscribe before reading the stored axes, so that no axis is missed in between
+	sub := newSubscription(startKey, endKey, tag, mode, keys)
+	axisStream.subscribe(sub)
+	defer axisStream.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", streamRetry); err != nil {
+		return
+	}
+	if snapshot != nil {
+		if err := writeEvent(w, "heatmap", 0, snapshot); err != nil {
+			lerr(err)
+			return
+		}
+	}
+	send := func(axis *DiscreteAxis) error {
+		id := axis.EndTime.Unix()
+		if id <= lastID {
+			return nil
+		}
+		lastID = id
+		return writeEvent(w, "axis", id, sub.project(axis))
+	}
+	if lastID != 0 {
+		var sendErr error
+		err = globalRegionStore.Scan(timeKey(time.Unix(lastID, 0)), nil, func(key, value []byte) bool {
+			var axis DiscreteAxis
+			perr(json.Unmarshal(value, &axis))
+			sendErr = send(&axis)
+			return sendErr == nil
+		})
+		if err != nil {
+			lerr(err)
+		}
+		if err != nil || sendErr != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case axis, ok := <-sub.axes:
+			// the subscription is closed because the client is too slow
+			if !ok {
+				return
+			}
+			if err := send(axis); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const teststreampath = "../test/stream"
+
+// readEvent reads the next event of a Server-Sent Events stream
+func readEvent(reader *bufio.Reader) (event string, id string, data string) {
+	for {
+		line, err := reader.ReadString('\n')
+		perr(err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	globalRegionStore.LeveldbStorage, _ = NewLeveldbStorage(teststreampath)
+	defer globalRegionStore.LeveldbStorage.Close()
+
+	start := time.Unix(1574000000, 0)
+	newAxis := func(i int) *DiscreteAxis {
+		return &DiscreteAxis{
+			EndTime: start.Add(time.Duration(i) * time.Minute),
+			Lines: []*Line{
+				{EndKey: GenTablePrefix(45), RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, 1, 0))},
+				{EndKey: GenTablePrefix(46), RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, uint64(10*(i+1)), 0))},
+				{EndKey: "~", RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, 2, 0))},
+			},
+		}
+	}
+	for i := 0; i < 2; i++ {
+		value, err := json.Marshal(newAxis(i))
+		perr(err)
+		perr(globalRegionStore.Save(timeKey(newAxis(i).EndTime), value))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer server.Close()
+	query := url.Values{"tag": {"read_bytes"}, "keys": {strings.Join([]string{"", GenTablePrefix(45), "~"}, ",")}}
+	request, err := http.NewRequest("GET", server.URL+"?"+query.Encode(), nil)
+	perr(err)
+	request.Header.Set("Last-Event-ID", "1574000000")
+	resp, err := http.DefaultClient.Do(request)
+	perr(err)
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("error content type %s", resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+
+	// the axis stored after the last event id is sent first
+	check := func(expectID string, expect []interface{}) {
+		event, id, data := readEvent(reader)
+		var column StreamColumn
+		perr(json.Unmarshal([]byte(data), &column))
+		if event != "axis" || id != expectID || !reflect.DeepEqual(column.Values, expect) {
+			t.Fatalf("error event %s %s %s", event, id, data)
+		}
+	}
+	check("1574000060", []interface{}{1.0, 20.0})
+
+	// wait for the subscription
+	for {
+		axisStream.Lock()
+		n := len(axisStream.subscriptions)
+		axisStream.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// an axis which has been sent is skipped
+	axisStream.publish(newAxis(1))
+	axisStream.publish(newAxis(2))
+	check("1574000120", []interface{}{1.0, 30.0})
+
+	for _, query := range []string{"tag=unknown", "keys=b,a", "last_event_id=x"} {
+		recorder := httptest.NewRecorder()
+		streamHandler(recorder, httptest.NewRequest("GET", "/heatmaps/stream?"+query, nil))
+		if recorder.Code != 400 {
+			t.Fatalf("%s: expect 400, but got %d", query, recorder.Code)
+		}
+	}
+}
+
+func TestAxisHub_publish(t *testing.T) {
+	hub := axisHub{subscriptions: make(map[*subscription]struct{})}
+	slow := newSubscription("", "~", "", "", []string{"", "~"})
+	hub.subscribe(slow)
+	for i := 0; i <= streamQueueSize; i++ {
+		hub.publish(&DiscreteAxis{})
+	}
+	// the slow subscription is closed after its queue is full
+	for i := 0; i < streamQueueSize; i++ {
+		<-slow.axes
+	}
+	if _, ok := <-slow.axes; ok || len(hub.subscriptions) != 0 {
+		t.Fatalf("the slow subscription is not closed")
+	}
+	hub.unsubscribe(slow)
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"github.com/pingcap/goleveldb/leveldb"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
-const defaulttablePath = "../storage/table"
-
 // Table saves the info of a table
 type Table struct {
 	Name string `json:"name"`
@@ -16,6 +19,81 @@ type Table struct {
 	ID   int64  `json:"id"`
 
 	Indices map[int64]string `json:"indices"`
+	// the physical IDs and names of partitions if the table is partitioned
+	Partitions map[int64]string `json:"partitions,omitempty"`
+	// the record keys are encoded by the primary key rather than an int handle
+	IsCommonHandle bool `json:"is_common_handle,omitempty"`
+
+	// the schema is in effect during [Since, Until)
+	// a zero Since means it has been in effect since the beginning of the history
+	// a zero Until means it is still in effect
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	// the reason why the table ends at Until, which is empty if it is replaced by a newer version
+	State string `json:"state,omitempty"`
+	// tells apart the versions of the table which start in the same second
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+const (
+	tableStateDropped   = "dropped"
+	tableStateTruncated = "truncated"
+)
+
+// sameSchema checks if two versions of a table have the same schema
+func (t *Table) sameSchema(other *Table) bool {
+	a, b := *t, *other
+	a.Since, a.Until, a.State, a.Seq = time.Time{}, time.Time{}, "", 0
+	b.Since, b.Until, b.State, b.Seq = time.Time{}, time.Time{}, "", 0
+	return reflect.DeepEqual(a, b)
+}
+
+// inEffect checks if the table is in effect at some time during [startTime, endTime]
+func (t *Table) inEffect(startTime time.Time, endTime time.Time) bool {
+	return !t.Since.After(endTime) && (t.Until.IsZero() || t.Until.After(startTime))
+}
+
+// endedAt checks if the table has been dropped or truncated until the given time
+func (t *Table) endedAt(at time.Time) bool {
+	return t.State != "" && !t.Until.IsZero() && !t.Until.After(at)
+}
+
+// the storage key of a version of the table, which is the table ID followed by the start time of the version,
+// and the sequence number if other versions start in the same second.
+// versions that have been in effect since the beginning use the table ID only, as the earlier versions of this store do
+func (t *Table) storageKey() []byte {
+	if t.Since.IsZero() {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(t.ID))
+		return key
+	}
+	key := make([]byte, 16, 24)
+	binary.BigEndian.PutUint64(key, uint64(t.ID))
+	binary.BigEndian.PutUint64(key[8:], uint64(t.Since.Unix()))
+	if t.Seq > 0 {
+		key = key[:24]
+		binary.BigEndian.PutUint64(key[16:], t.Seq)
+	}
+	return key
+}
+
+// physicalTable is a table or a partition of a table, which owns a key range of its own
+type physicalTable struct {
+	ID        int64
+	Partition string // the name of the partition, empty if the table is not partitioned
+}
+
+// physicalTables returns the partitions of a partitioned table, or the table itself
+func (t *Table) physicalTables() []physicalTable {
+	if len(t.Partitions) == 0 {
+		return []physicalTable{{t.ID, ""}}
+	}
+	physicals := make([]physicalTable, 0, len(t.Partitions))
+	for id, name := range t.Partitions {
+		physicals = append(physicals, physicalTable{id, name})
+	}
+	sort.Slice(physicals, func(i, j int) bool { return physicals[i].ID < physicals[j].ID })
+	return physicals
 }
 
 // TableSlice is the slice of tables
@@ -37,57 +115,269 @@ func (s TableSlice) Less(i, j int) bool {
 type TablesStore struct {
 	sync.RWMutex
 	*LeveldbStorage
+	// the in-memory index of key ranges for labeling, the tables still in effect ordered by TableSlice,
+	// and whether the table of each physical ID is clustered, which are rebuilt after each synchronization
+	index         *LabelIndex
+	current       []*Table
+	commonHandles map[int64]bool
 }
 
-func loadTables() []*Table {
+// versions returns all the versions of all the tables, the caller should hold the lock
+func (s *TablesStore) versions() []*Table {
 	tableSlice := make([]*Table, 0)
-	tables.RLock()
-	allValue := tables.Traversal()
-	tables.RUnlock()
-	for _, v := range allValue {
+	for _, v := range s.Traversal() {
 		var table Table
 		err := json.Unmarshal([]byte(v), &table)
 		perr(err)
 		tableSlice = append(tableSlice, &table)
 	}
+	return tableSlice
+}
+
+func (s *TablesStore) save(table *Table) {
+	value, err := json.Marshal(table)
+	perr(err)
+	err = s.Save(table.storageKey(), value)
+	perr(err)
+}
+
+// loadTables returns the tables which are still in effect, which are shared and must not be modified
+func loadTables() []*Table {
+	tables.RLock()
+	defer tables.RUnlock()
+	return append([]*Table(nil), tables.current...)
+}
+
+// loadTablesAt returns the tables which are in effect during [startTime, endTime],
+// for a table which has several versions in the range, the latest one is used
+func loadTablesAt(startTime time.Time, endTime time.Time) []*Table {
+	tables.RLock()
+	versions := tables.versions()
+	tables.RUnlock()
+	latest := make(map[int64]*Table, len(versions))
+	for _, table := range versions {
+		if !table.inEffect(startTime, endTime) {
+			continue
+		}
+		if v, ok := latest[table.ID]; !ok || v.Since.Before(table.Since) {
+			latest[table.ID] = table
+		}
+	}
+	tableSlice := make([]*Table, 0, len(latest))
+	for _, table := range latest {
+		tableSlice = append(tableSlice, table)
+	}
 	sort.Sort(TableSlice(tableSlice))
 	return tableSlice
 }
 
-func updateTables() {
-	dbInfos := dbRequest(0)
-	tables.Lock()
-	defer tables.Unlock()
+// fetchTables gets the current schema of the given databases from TiDB, or all databases if dbs is nil.
+// Database names in dbs are lowercase. At most *schemaConcurrency requests are sent at the same time.
+func fetchTables(ctx context.Context, dbs map[string]struct{}) ([]*Table, error) {
+	snapshot := make([]*Table, 0)
+	dbInfos, err := dbRequest(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	limit := make(chan struct{}, *schemaConcurrency)
 	for _, info := range dbInfos {
 		if info.State == 0 {
 			continue
 		}
-		tblInfos := tableRequest(0, info.Name.O)
-
-		for _, table := range tblInfos {
-			indices := make(map[int64]string, len(table.Indices))
-			for _, index := range table.Indices {
-				indices[index.ID] = index.Name.O
+		if _, ok := dbs[info.Name.L]; dbs != nil && !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(db string) {
+			defer wg.Done()
+			limit <- struct{}{}
+			tblInfos, err := tableRequest(ctx, 0, db)
+			<-limit
+			dbTables := make([]*Table, 0, len(tblInfos))
+			for _, table := range tblInfos {
+				dbTables = append(dbTables, newTable(db, table))
 			}
-			newTable := &Table{
-				ID:      table.ID,
-				Name:    table.Name.O,
-				DB:      info.Name.O,
-				Indices: indices,
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
 			}
+			snapshot = append(snapshot, dbTables...)
+		}(info.Name.O)
+	}
+	wg.Wait()
+	// a partial snapshot would mark the missing tables as dropped
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return snapshot, nil
+}
 
-			value, err := json.Marshal(newTable)
-			perr(err)
-			var key = make([]byte, 8)
-			binary.BigEndian.PutUint64(key, uint64(newTable.ID))
-			err = tables.Save(key, value)
-			perr(err)
+// newTable converts the schema of a table returned by TiDB
+func newTable(db string, table *tableInfo) *Table {
+	indices := make(map[int64]string, len(table.Indices))
+	for _, index := range table.Indices {
+		// the primary key of a clustered table is stored as the record keys
+		if table.IsCommonHandle && index.Primary {
+			continue
+		}
+		indices[index.ID] = index.Name.O
+	}
+	newTable := &Table{
+		ID:             table.ID,
+		Name:           table.Name.O,
+		DB:             db,
+		Indices:        indices,
+		IsCommonHandle: table.IsCommonHandle,
+	}
+	if table.Partition != nil && len(table.Partition.Definitions) > 0 {
+		newTable.Partitions = make(map[int64]string, len(table.Partition.Definitions))
+		for _, def := range table.Partition.Definitions {
+			newTable.Partitions[def.ID] = def.Name.O
 		}
 	}
+	return newTable
 }
 
-var tables TablesStore
+// applySnapshot compares a snapshot of the schema taken at now with the versions in effect,
+// ends the versions which are changed, dropped or truncated, and starts the new ones.
+// The snapshot only covers the given lowercase database names, or all databases if dbs is nil.
+func (s *TablesStore) applySnapshot(snapshot []*Table, dbs map[string]struct{}, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	versions := s.versions()
+	// the tables synchronized for the first time are regarded as existing since the beginning
+	since := now
+	if len(versions) == 0 {
+		since = time.Time{}
+	}
+	current := make(map[int64]*Table, len(versions))
+	for _, table := range versions {
+		if table.Until.IsZero() {
+			current[table.ID] = table
+		}
+	}
+
+	snapshotIDs := make(map[int64]struct{}, len(snapshot))
+	snapshotNames := make(map[string]struct{}, len(snapshot))
+	for _, table := range snapshot {
+		snapshotIDs[table.ID] = struct{}{}
+		snapshotNames[strings.ToLower(table.DB+"."+table.Name)] = struct{}{}
+		old, ok := current[table.ID]
+		if ok && old.sameSchema(table) {
+			continue
+		}
+		if ok {
+			old.Until = now
+			s.save(old)
+		}
+		newTable := *table
+		newTable.Since, newTable.Until, newTable.State, newTable.Seq = since, time.Time{}, "", 0
+		if !since.IsZero() {
+			for _, version := range versions {
+				if version.ID == table.ID && version.Since.Unix() == since.Unix() && version.Seq >= newTable.Seq {
+					newTable.Seq = version.Seq + 1
+				}
+			}
+		}
+		s.save(&newTable)
+	}
+
+	for id, old := range current {
+		if _, ok := snapshotIDs[id]; ok {
+			continue
+		}
+		// the tables of databases out of the snapshot are unknown
+		if _, ok := dbs[strings.ToLower(old.DB)]; dbs != nil && !ok {
+			continue
+		}
+		// a truncated table is replaced by a new table with the same name
+		old.State = tableStateDropped
+		if _, ok := snapshotNames[strings.ToLower(old.DB+"."+old.Name)]; ok {
+			old.State = tableStateTruncated
+		}
+		old.Until = now
+		s.save(old)
+	}
+	s.refreshIndex()
+}
+
+// pruneBefore deletes the versions which ended before t, and returns the amount of deleted versions
+func (s *TablesStore) pruneBefore(t time.Time) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	batch := new(leveldb.Batch)
+	for _, table := range s.versions() {
+		if !table.Until.IsZero() && table.Until.Before(t) {
+			batch.Delete(table.storageKey())
+		}
+	}
+	if batch.Len() == 0 {
+		return 0, nil
+	}
+	if err := s.Write(batch, nil); err != nil {
+		return 0, err
+	}
+	s.refreshIndex()
+	return batch.Len(), nil
+}
+
+// open replaces the storage of the tables, and builds the index of key ranges from it
+func (s *TablesStore) open(storage *LeveldbStorage) {
+	s.Lock()
+	defer s.Unlock()
+	s.LeveldbStorage = storage
+	s.refreshIndex()
+}
+
+// refreshIndex rebuilds the index of key ranges and the tables in effect, the caller should hold the write lock
+func (s *TablesStore) refreshIndex() {
+	versions := s.versions()
+	s.index = buildTableIndex(versions)
+	s.current = make([]*Table, 0, len(versions))
+	s.commonHandles = make(map[int64]bool, len(versions))
+	for _, table := range versions {
+		if table.Until.IsZero() {
+			s.current = append(s.current, table)
+		}
+		// the keys of a dropped table may still be shown, and a table cannot change its primary key between clustered or not
+		s.commonHandles[table.ID] = table.IsCommonHandle
+		for _, physical := range table.physicalTables() {
+			s.commonHandles[physical.ID] = table.IsCommonHandle
+		}
+	}
+	sort.Sort(TableSlice(s.current))
+}
+
+// commonHandle tells whether the table of the physical ID is clustered, known is false if the table is not in the schema
+func (s *TablesStore) commonHandle(id int64) (isCommonHandle bool, known bool) {
+	s.RLock()
+	defer s.RUnlock()
+	isCommonHandle, known = s.commonHandles[id]
+	return isCommonHandle, known
+}
 
-func init() {
-	tables.LeveldbStorage, _ = NewLeveldbStorage(defaulttablePath)
+// labelIndex returns the index of key ranges
+func (s *TablesStore) labelIndex() *LabelIndex {
+	s.RLock()
+	defer s.RUnlock()
+	return s.index
 }
+
+// updateTables synchronizes the schema of all databases
+func updateTables(ctx context.Context) error {
+	snapshot, err := fetchTables(ctx, nil)
+	if err != nil {
+		return err
+	}
+	tables.applySnapshot(snapshot, nil, time.Now())
+	return nil
+}
+
+var tables TablesStore
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long an unhealthy TiDB server is skipped before it is tried again
+const tidbRetryInterval = 30 * time.Second
+
+// tidbPool manages the status addresses of several TiDB servers,
+// requests are sent to healthy servers in round-robin, and fail over to the next one on errors
+type tidbPool struct {
+	sync.Mutex
+	source    string               // the flag value which the pool is built from
+	addrs     []string             // status addresses of TiDB servers
+	unhealthy map[string]time.Time // the addresses which are unhealthy and the time to try them again
+	next      int                  // the index of the address to use next
+}
+
+func newTidbPool(source string) *tidbPool {
+	pool := &tidbPool{
+		source:    source,
+		unhealthy: make(map[string]time.Time),
+	}
+	for _, addr := range strings.Split(source, ",") {
+		if addr = strings.TrimRight(strings.TrimSpace(addr), "/"); addr != "" {
+			pool.addrs = append(pool.addrs, addr)
+		}
+	}
+	return pool
+}
+
+var (
+	tidbPoolMu     sync.Mutex
+	globalTidbPool *tidbPool
+)
+
+// getTidbPool returns the pool of the servers given by -tidb
+func getTidbPool() *tidbPool {
+	tidbPoolMu.Lock()
+	defer tidbPoolMu.Unlock()
+	if globalTidbPool == nil || globalTidbPool.source != *tidbAddr {
+		globalTidbPool = newTidbPool(*tidbAddr)
+	}
+	return globalTidbPool
+}
+
+// candidates returns the addresses to try in order, healthy ones first
+func (p *tidbPool) candidates(now time.Time) []string {
+	p.Lock()
+	defer p.Unlock()
+	healthy := make([]string, 0, len(p.addrs))
+	unhealthy := make([]string, 0)
+	for i := range p.addrs {
+		addr := p.addrs[(p.next+i)%len(p.addrs)]
+		if retry, ok := p.unhealthy[addr]; ok && now.Before(retry) {
+			unhealthy = append(unhealthy, addr)
+		} else {
+			healthy = append(healthy, addr)
+		}
+	}
+	if len(p.addrs) > 0 {
+		p.next = (p.next + 1) % len(p.addrs)
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (p *tidbPool) markHealth(addr string, err error) {
+	p.Lock()
+	defer p.Unlock()
+	if err == nil {
+		delete(p.unhealthy, addr)
+	} else {
+		p.unhealthy[addr] = time.Now().Add(tidbRetryInterval)
+	}
+}
+
+// unhealthyAddrs returns the addresses whose last request failed
+func (p *tidbPool) unhealthyAddrs() []string {
+	p.Lock()
+	defer p.Unlock()
+	addrs := make([]string, 0, len(p.unhealthy))
+	for addr := range p.unhealthy {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// request sends the request to the servers in turn until one of them succeeds
+func (p *tidbPool) request(ctx context.Context, uri string, v interface{}) error {
+	addrs := p.candidates(time.Now())
+	if len(addrs) == 0 {
+		return errors.New("no TiDB address is given")
+	}
+	errs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		err := request(ctx, addr, uri, v)
+		// a canceled request tells nothing about the health of the server
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p.markHealth(addr, err)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return fmt.Errorf("all TiDB servers failed: %s", strings.Join(errs, "; "))
+}
+
+// checkHealth requests the status of every server, and marks whether it is healthy
+func (p *tidbPool) checkHealth(ctx context.Context) {
+	p.Lock()
+	addrs := append([]string(nil), p.addrs...)
+	p.Unlock()
+	for _, addr := range addrs {
+		var status interface{}
+		err := request(ctx, addr, "status", &status)
+		if ctx.Err() != nil {
+			return
+		}
+		p.markHealth(addr, err)
+	}
+}
+
+func checkTidbHealth(ctx context.Context) {
+	ticker := time.NewTicker(tidbRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			getTidbPool().checkHealth(ctx)
+		}
+	}
+}
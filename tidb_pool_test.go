@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTidbPool_request(t *testing.T) {
+	counts := make(map[string]int)
+	newServer := func(name string, healthy *bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			counts[name]++
+			if !*healthy {
+				http.Error(w, "restarting", http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte(`"` + name + `"`))
+		}))
+	}
+	healthyA, healthyB := true, true
+	serverA := newServer("a", &healthyA)
+	defer serverA.Close()
+	serverB := newServer("b", &healthyB)
+	defer serverB.Close()
+
+	pool := newTidbPool(serverA.URL + ", " + serverB.URL + "/")
+	if len(pool.addrs) != 2 || pool.addrs[1] != serverB.URL {
+		t.Fatalf("error addresses %v", pool.addrs)
+	}
+
+	// round-robin
+	var result string
+	for i := 0; i < 4; i++ {
+		perr(pool.request(context.Background(), "status", &result))
+	}
+	if counts["a"] != 2 || counts["b"] != 2 {
+		t.Fatalf("expect requests are balanced, but got %v", counts)
+	}
+
+	// fail over to b, and skip a until it is tried again
+	healthyA = false
+	for i := 0; i < 4; i++ {
+		if err := pool.request(context.Background(), "status", &result); err != nil || result != "b" {
+			t.Fatalf("expect b, but got %s, %v", result, err)
+		}
+	}
+	if counts["a"] != 3 {
+		t.Fatalf("expect a is requested only once after it fails, but got %v", counts)
+	}
+
+	// all servers fail
+	healthyB = false
+	if err := pool.request(context.Background(), "status", &result); err == nil {
+		t.Fatalf("expect error when all servers fail")
+	}
+
+	// a recovers after the health check
+	healthyA = true
+	pool.checkHealth(context.Background())
+	if _, ok := pool.unhealthy[serverA.URL]; ok {
+		t.Fatalf("expect a is healthy after the health check")
+	}
+	if addrs := pool.unhealthyAddrs(); len(addrs) != 1 || addrs[0] != serverB.URL {
+		t.Fatalf("expect b is unhealthy after the health check, but got %v", addrs)
+	}
+
+	// a canceled request fails without marking the servers unhealthy
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pool.request(ctx, "status", &result); err != context.Canceled {
+		t.Fatalf("expect canceled, but got %v", err)
+	}
+	if _, ok := pool.unhealthy[serverA.URL]; ok {
+		t.Fatalf("expect a is still healthy after a canceled request")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/pingcap/goleveldb/leveldb"
 	"reflect"
 	"testing"
@@ -11,13 +12,13 @@ const testtablepath = "../test/table"
 
 func TestUpdateAndLoadTables(t *testing.T) {
 	time.Sleep(time.Second)
-	tables.LeveldbStorage, _ = NewLeveldbStorage(testtablepath)
-	updateTables()
+	openTestTables(testtablepath)
+	updateTables(context.Background())
 	tablesBefore := loadTables()
 	tables.Close()
 	db, err := leveldb.OpenFile(testtablepath, nil)
 	perr(err)
-	tables.LeveldbStorage = &LeveldbStorage{db}
+	tables.open(&LeveldbStorage{db})
 
 	tablesAfter := loadTables()
 
@@ -82,3 +83,122 @@ func TestTableSlice_Less(t *testing.T) {
 		t.Fatalf("error less")
 	}
 }
+
+func TestTable_physicalTables(t *testing.T) {
+	table := &Table{Name: "orders", DB: "sales", ID: 45}
+	expect := []physicalTable{{45, ""}}
+	if result := table.physicalTables(); !reflect.DeepEqual(result, expect) {
+		t.Fatalf("expect %v, but got %v", expect, result)
+	}
+	table.Partitions = map[int64]string{47: "p1", 46: "p0"}
+	expect = []physicalTable{{46, "p0"}, {47, "p1"}}
+	if result := table.physicalTables(); !reflect.DeepEqual(result, expect) {
+		t.Fatalf("expect %v, but got %v", expect, result)
+	}
+}
+
+const testtablehistorypath = "../test/table_history"
+
+func TestTablesStore_applySnapshot(t *testing.T) {
+	openTestTables(testtablehistorypath)
+	defer tables.LeveldbStorage.Close()
+	iter := tables.NewIterator(nil, nil)
+	for iter.Next() {
+		perr(tables.Delete(iter.Key(), nil))
+	}
+	iter.Release()
+
+	names := func(tableSlice []*Table, at time.Time) []string {
+		result := make([]string, 0, len(tableSlice))
+		for _, table := range tableSlice {
+			name := table.Name
+			if table.endedAt(at) {
+				name += " (" + table.State + ")"
+			}
+			result = append(result, name)
+		}
+		return result
+	}
+	check := func(expect []string, result []string) {
+		if !reflect.DeepEqual(expect, result) {
+			t.Fatalf("expect %v, but got %v", expect, result)
+		}
+	}
+
+	t0 := time.Unix(1571900000, 0)
+	t1 := t0.Add(time.Hour)
+	t2 := t1.Add(time.Hour)
+	tables.applySnapshot([]*Table{
+		{Name: "orders", DB: "sales", ID: 45},
+		{Name: "users", DB: "sales", ID: 46},
+	}, nil, t0)
+	// orders is renamed and users is truncated
+	tables.applySnapshot([]*Table{
+		{Name: "orders_v2", DB: "sales", ID: 45},
+		{Name: "users", DB: "sales", ID: 47},
+	}, nil, t1)
+	check([]string{"orders_v2", "users"}, names(loadTables(), t1))
+	// the tables synchronized for the first time are in effect since the beginning
+	check([]string{"orders", "users"}, names(loadTablesAt(t0.Add(-time.Hour), t0), t0))
+	check([]string{"orders_v2", "users (truncated)", "users"}, names(loadTablesAt(t0, t1.Add(time.Minute)), t1.Add(time.Minute)))
+	check([]string{"orders_v2", "users"}, names(loadTablesAt(t1, t1.Add(time.Minute)), t1.Add(time.Minute)))
+
+	// nothing changes
+	tables.applySnapshot([]*Table{
+		{Name: "orders_v2", DB: "sales", ID: 45},
+		{Name: "users", DB: "sales", ID: 47},
+	}, nil, t1.Add(time.Minute))
+	if len(tables.versions()) != 4 {
+		t.Fatalf("expect 4 versions, but got %d", len(tables.versions()))
+	}
+
+	// users is dropped
+	tables.applySnapshot([]*Table{
+		{Name: "orders_v2", DB: "sales", ID: 45},
+	}, nil, t2)
+	check([]string{"orders_v2"}, names(loadTables(), t2))
+	check([]string{"orders_v2", "users (dropped)"}, names(loadTablesAt(t1, t2), t2))
+	check([]string{"orders_v2", "users"}, names(loadTablesAt(t1, t2), t1))
+
+	// the versions started in the same second are kept apart
+	t3 := t2.Add(time.Hour)
+	tables.applySnapshot([]*Table{{Name: "orders_v3", DB: "sales", ID: 45}}, nil, t3)
+	tables.applySnapshot([]*Table{{Name: "orders_v4", DB: "sales", ID: 45}}, nil, t3.Add(time.Millisecond))
+	if len(tables.versions()) != 6 {
+		t.Fatalf("expect 6 versions, but got %d", len(tables.versions()))
+	}
+	check([]string{"orders_v4"}, names(loadTables(), t3))
+
+	// the versions ended before the retention are pruned
+	n, err := tables.pruneBefore(t2)
+	perr(err)
+	if n != 2 || len(tables.versions()) != 4 {
+		t.Fatalf("expect 2 versions pruned and 4 left, but got %d and %d", n, len(tables.versions()))
+	}
+	check([]string{"orders_v2", "users (dropped)"}, names(loadTablesAt(t1, t2), t2))
+}
+
+const testtablehandlepath = "../test/table_handle"
+
+func TestTablesStore_commonHandle(t *testing.T) {
+	openTestTables(testtablehandlepath)
+	defer tables.LeveldbStorage.Close()
+	saveTestTables(
+		&Table{Name: "orders", DB: "sales", ID: 45},
+		&Table{Name: "clustered", DB: "sales", ID: 46, IsCommonHandle: true, Partitions: map[int64]string{47: "p0"}},
+	)
+	for _, c := range []struct {
+		id             int64
+		isCommonHandle bool
+		known          bool
+	}{
+		{45, false, true},
+		{46, true, true},
+		{47, true, true},
+		{48, false, false},
+	} {
+		if isCommonHandle, known := tables.commonHandle(c.id); isCommonHandle != c.isCommonHandle || known != c.known {
+			t.Fatalf("table %d: expect %v %v, but got %v %v", c.id, c.isCommonHandle, c.known, isCommonHandle, known)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	groupByRegion = "region"
+	groupByTable  = "table"
+
+	// the default and the maximum amount of key ranges returned by the top-N API
+	defaultTopN = 10
+	maxTopN     = 1000
+)
+
+// TopNItem is a hot key range with its value aggregated in the time range
+type TopNItem struct {
+	StartKey string   `json:"start_key"`
+	EndKey   string   `json:"end_key"`
+	Label    string   `json:"label,omitempty"` // the table, index or label rule if grouped by table
+	Value    uint64   `json:"value"`
+	Share    float64  `json:"share"`  // the share of Value in the total value of the key range of the request
+	Series   []uint64 `json:"series"` // the value at each of Times
+}
+
+// TopN is the hottest key ranges in a time range
+type TopN struct {
+	Tag     string      `json:"tag"`
+	GroupBy string      `json:"group_by"`
+	Times   []time.Time `json:"times"`
+	Total   uint64      `json:"total"`
+	Items   []*TopNItem `json:"items"`
+}
+
+// isHeatmapTag checks if tag is one of heatmapTags
+func isHeatmapTag(tag string) bool {
+	for _, info := range heatmapTags {
+		if info.Name == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// the amount of hex digits read by keyPosition, whose value fits in the mantissa of a float64
+const keyPositionDigits = 13
+
+// hexDigit returns the value of a hex digit of a key, where "~", the end of the key space, follows "F"
+func hexDigit(c byte) float64 {
+	switch {
+	case c >= '0' && c <= '9':
+		return float64(c - '0')
+	case c >= 'A' && c <= 'F':
+		return float64(c-'A') + 10
+	case c >= 'a' && c <= 'f':
+		return float64(c-'a') + 10
+	}
+	return 16
+}
+
+// keyPosition approximates the position of the hex key in [startKey, endKey] as a number in [0, 1],
+// by reading the hex digits following the common prefix of startKey and endKey as a fraction
+func keyPosition(key string, startKey string, endKey string) float64 {
+	if key <= startKey {
+		return 0
+	}
+	if key >= endKey {
+		return 1
+	}
+	prefix := 0
+	for prefix < len(startKey) && prefix < len(endKey) && startKey[prefix] == endKey[prefix] {
+		prefix++
+	}
+	number := func(s string) float64 {
+		var v float64
+		for i := prefix; i < prefix+keyPositionDigits; i++ {
+			v *= 16
+			if i < len(s) {
+				v += hexDigit(s[i])
+			}
+		}
+		return v
+	}
+	low, high := number(startKey), number(endKey)
+	if high <= low {
+		return 0
+	}
+	return (number(key) - low) / (high - low)
+}
+
+// overlapValue returns the part of value of the line [startKey, endKey) which falls into [overlapStart, overlapEnd)
+func overlapValue(value uint64, startKey string, endKey string, overlapStart string, overlapEnd string) uint64 {
+	if overlapStart <= startKey && overlapEnd >= endKey {
+		return value
+	}
+	ratio := keyPosition(overlapEnd, startKey, endKey) - keyPosition(overlapStart, startKey, endKey)
+	if ratio <= 0 {
+		return 0
+	}
+	return uint64(math.Round(float64(value) * ratio))
+}
+
+func maxKey(a string, b string) string {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minKey(a string, b string) string {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// topNLine is a line of a stored axis which covers [startKey, endKey)
+type topNLine struct {
+	startKey string
+	endKey   string
+	value    uint64
+}
+
+// computeTopN returns the n key ranges with the biggest total value of tag in [startKey, endKey) during the time range.
+// Lines are merged by their exact key ranges if grouped by region. If grouped by table, they are merged by the labels
+// of tables, indices and label rules they overlap, and a line overlapping several labels is split among them
+// in proportion to the key ranges they overlap, which is approximated by the positions of keys.
+func computeTopN(startTime time.Time, endTime time.Time, startKey string, endKey string, tag string, groupBy string, n int) *TopN {
+	topN := &TopN{
+		Tag:     tag,
+		GroupBy: groupBy,
+		Times:   make([]time.Time, 0),
+		Items:   make([]*TopNItem, 0),
+	}
+	plane := globalRegionStore.Range(startTime, endTime, separateValueFunc(tag, ""))
+	if plane == nil {
+		return topN
+	}
+	var index *LabelIndex
+	if groupBy == groupByTable {
+		index = tables.labelIndex()
+	}
+	groups := make(map[string]*TopNItem)
+	for i, axis := range plane.Axes {
+		topN.Times = append(topN.Times, axis.EndTime)
+		lineStart := axis.StartKey
+		lines := make([]topNLine, 0, len(axis.Lines))
+		for _, line := range axis.Lines {
+			if line.EndKey > startKey && lineStart < endKey {
+				lines = append(lines, topNLine{lineStart, line.EndKey, line.Value.(*SingleUnit).Value})
+			}
+			lineStart = line.EndKey
+		}
+		for _, line := range lines {
+			// a line reaching out of the key range only counts the part in it
+			value := overlapValue(line.value, line.startKey, line.endKey, startKey, endKey)
+			topN.Total += value
+			if value == 0 {
+				continue
+			}
+			items := make([]*TopNItem, 0, 1)
+			values := make([]uint64, 0, 1)
+			if groupBy == groupByRegion {
+				items = append(items, &TopNItem{StartKey: line.startKey, EndKey: line.endKey})
+				values = append(values, value)
+			} else {
+				for _, label := range queryLabels(index, line.startKey, line.endKey, startTime, endTime) {
+					items = append(items, &TopNItem{StartKey: label.StartKey, EndKey: label.EndKey, Label: label.String()})
+					overlapStart, overlapEnd := maxKey(label.StartKey, startKey), minKey(label.EndKey, endKey)
+					values = append(values, overlapValue(line.value, line.startKey, line.endKey, overlapStart, overlapEnd))
+				}
+			}
+			for j, item := range items {
+				if values[j] == 0 {
+					continue
+				}
+				id := item.StartKey + "/" + item.EndKey + "/" + item.Label
+				group, ok := groups[id]
+				if !ok {
+					group = item
+					group.Series = make([]uint64, len(plane.Axes))
+					groups[id] = group
+				}
+				group.Value += values[j]
+				group.Series[i] += values[j]
+			}
+		}
+	}
+	for _, item := range groups {
+		if topN.Total > 0 {
+			item.Share = float64(item.Value) / float64(topN.Total)
+		}
+		topN.Items = append(topN.Items, item)
+	}
+	sort.Slice(topN.Items, func(i, j int) bool {
+		a, b := topN.Items[i], topN.Items[j]
+		if a.Value != b.Value {
+			return a.Value > b.Value
+		}
+		if a.StartKey != b.StartKey {
+			return a.StartKey < b.StartKey
+		}
+		return a.Label < b.Label
+	})
+	if len(topN.Items) > n {
+		topN.Items = topN.Items[:n]
+	}
+	return topN
+}
+
+// topNHandler returns the n hottest key ranges, tag is read_and_written_bytes and group_by is region by default
+func topNHandler(w http.ResponseWriter, r *http.Request) {
+	startTime, endTime, err := parseTimeRange(r.FormValue("starttime"), r.FormValue("endtime"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	startKey, endKey, err := parseKeyRange(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tag := r.FormValue("tag")
+	if tag == "" {
+		tag = "read_and_written_bytes"
+	}
+	if !isHeatmapTag(tag) {
+		http.Error(w, fmt.Sprintf("invalid tag %q", tag), http.StatusBadRequest)
+		return
+	}
+	groupBy := r.FormValue("group_by")
+	if groupBy == "" {
+		groupBy = groupByRegion
+	}
+	if groupBy != groupByRegion && groupBy != groupByTable {
+		http.Error(w, fmt.Sprintf("invalid group_by %q, expect %s or %s", groupBy, groupByRegion, groupByTable), http.StatusBadRequest)
+		return
+	}
+	n := defaultTopN
+	if s := r.FormValue("n"); s != "" {
+		n, err = strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxTopN {
+			http.Error(w, fmt.Sprintf("invalid n %q, expect an integer in [1, %d]", s, maxTopN), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := globalRegionStore.CheckRange(startTime, endTime); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, computeTopN(startTime, endTime, startKey, endKey, tag, groupBy, n))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	testtopnregionpath = "../test/topn_region"
+	testtopntablepath  = "../test/topn_table"
+)
+
+func TestComputeTopN(t *testing.T) {
+	globalRegionStore.LeveldbStorage, _ = NewLeveldbStorage(testtopnregionpath)
+	defer globalRegionStore.LeveldbStorage.Close()
+	openTestTables(testtopntablepath)
+	defer tables.LeveldbStorage.Close()
+	saveTestTables(
+		&Table{Name: "orders", DB: "sales", ID: 45, Indices: map[int64]string{1: "idx"}},
+		&Table{Name: "users", DB: "sales", ID: 46, Indices: map[int64]string{}},
+	)
+
+	start := time.Unix(1574000000, 0)
+	for i, hot := range []uint64{10, 30} {
+		axis := &DiscreteAxis{
+			EndTime: start.Add(time.Duration(i) * time.Minute),
+			Lines: []*Line{
+				{EndKey: GenTablePrefix(45), RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, 1, 0))},
+				// the line covers two tables
+				{EndKey: GenTablePrefix(47), RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, hot, 0))},
+				{EndKey: "~", RegionUnit: newRegionUnit(newRegionInfo("", "", 0, 0, 5, 0))},
+			},
+		}
+		value, err := json.Marshal(axis)
+		perr(err)
+		perr(globalRegionStore.Save(timeKey(axis.EndTime), value))
+	}
+	endTime := start.Add(time.Minute)
+
+	topN := computeTopN(start, endTime, "", "~", "read_bytes", groupByRegion, 1)
+	if topN.Total != 52 || len(topN.Times) != 2 || len(topN.Items) != 1 {
+		t.Fatalf("error top-N %v", topN)
+	}
+	item := topN.Items[0]
+	if item.StartKey != GenTablePrefix(45) || item.EndKey != GenTablePrefix(47) || item.Value != 40 ||
+		math.Abs(item.Share-40.0/52) > 1e-9 || !reflect.DeepEqual(item.Series, []uint64{10, 30}) {
+		t.Fatalf("error item %v", item)
+	}
+
+	topN = computeTopN(start, endTime, "", "~", "read_bytes", groupByTable, 10)
+	labels := make([]string, 0, len(topN.Items))
+	for _, item := range topN.Items {
+		labels = append(labels, item.Label)
+	}
+	// the line is split among the labels by the key ranges they overlap, where the records of both tables take
+	// the same part of the line, and the value left to the index is too small to count
+	if !reflect.DeepEqual(labels, []string{"sales.orders", "sales.users"}) ||
+		!reflect.DeepEqual(topN.Items[0].Series, []uint64{3, 9}) || !reflect.DeepEqual(topN.Items[1].Series, []uint64{3, 9}) ||
+		topN.Items[0].StartKey != GenTableRecordPrefix(45) {
+		t.Fatalf("error items grouped by table %v", topN.Items)
+	}
+
+	// only the part of the lines in the key range are counted
+	topN = computeTopN(start, endTime, GenTablePrefix(46), "~", "read_bytes", groupByRegion, 10)
+	if topN.Total != 30 || len(topN.Items) != 2 || topN.Items[0].Value != 20 || topN.Items[0].Share != 20.0/30 {
+		t.Fatalf("error top-N in the key range %v", topN)
+	}
+	topN = computeTopN(start, endTime, GenTablePrefix(46), GenTablePrefix(47), "read_bytes", groupByTable, 10)
+	if topN.Total != 20 || len(topN.Items) != 1 || topN.Items[0].Label != "sales.users" || topN.Items[0].Value != 12 {
+		t.Fatalf("error top-N of a table in the key range %v", topN)
+	}
+
+	for _, query := range []string{"tag=unknown", "group_by=db", "n=0"} {
+		recorder := httptest.NewRecorder()
+		topNHandler(recorder, httptest.NewRequest("GET", "/api/v1/topn?"+query, nil))
+		if recorder.Code != 400 {
+			t.Fatalf("%s: expect 400, but got %d", query, recorder.Code)
+		}
+	}
+}
+
+func TestOverlapValue(t *testing.T) {
+	cases := []struct {
+		startKey string
+		endKey   string
+		expect   uint64
+	}{
+		{"", "~", 100},
+		{"A0", "C0", 100},
+		{"A0", "B0", 50},
+		{"B0", "D0", 50},
+		{"A8", "B0", 25},
+		{"D0", "E0", 0},
+	}
+	for _, c := range cases {
+		if result := overlapValue(100, "A0", "C0", c.startKey, c.endKey); result != c.expect {
+			t.Fatalf("[%s, %s): expect %d, but got %d", c.startKey, c.endKey, c.expect, result)
+		}
+	}
+	// the keys are hex digits, "9" is next to "A"
+	if result := overlapValue(100, "90", "B0", "A0", "B0"); result != 50 {
+		t.Fatalf("expect 50, but got %d", result)
+	}
+	if result := overlapValue(100, "F0", "~", "F8", "~"); result != 50 {
+		t.Fatalf("expect 50, but got %d", result)
+	}
+}
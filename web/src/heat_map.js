@@ -57,7 +57,7 @@ export function markColor(labels) {
     if (j > 0 && names.length === labels[j - 1].labels.length) {
       equal = true;
       names.forEach((name, i) => {
-        if (name !== labels[j-1].labels[i]) {
+        if (JSON.stringify(name) !== JSON.stringify(labels[j-1].labels[i])) {
           equal = false;
         }
       });